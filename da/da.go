@@ -0,0 +1,40 @@
+package da
+
+import "errors"
+
+var (
+	ERR_HEIGHT_NOT_FOUND = errors.New("the requested height has not been reached by the DA layer")
+)
+
+// A data availability layer, to which the sequencer posts batches of blocks and from which other nodes read them.
+// Each acknowledged post is assigned a height, and heights are strictly increasing.
+type DataAvailability interface {
+	// Posts a batch to the DA layer and blocks until the post is acknowledged.
+	// Returns the height at which the batch was included.
+	PostBatch(batch []byte) (uint64, error)
+	// Returns the batches included at the given height, in the order they were posted.
+	// Returns ERR_HEIGHT_NOT_FOUND if the height is greater than the latest height.
+	GetBatches(height uint64) ([][]byte, error)
+	// Returns the height of the latest batch included in the DA layer, or zero if nothing has been posted
+	LatestHeight() (uint64, error)
+	// Returns the height of the latest batch which can no longer be reverted, or zero if nothing is final
+	FinalizedHeight() (uint64, error)
+}
+
+// Indicates whether the batch at the given height has been included in the DA layer
+func IsIncluded(layer DataAvailability, height uint64) (bool, error) {
+	latest, err := layer.LatestHeight()
+	if err != nil {
+		return false, err
+	}
+	return height != 0 && height <= latest, nil
+}
+
+// Indicates whether the batch at the given height has been finalized by the DA layer
+func IsFinalized(layer DataAvailability, height uint64) (bool, error) {
+	finalized, err := layer.FinalizedHeight()
+	if err != nil {
+		return false, err
+	}
+	return height != 0 && height <= finalized, nil
+}
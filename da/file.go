@@ -0,0 +1,121 @@
+package da
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regent/utils"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const BATCH_FILE_EXTENSION = ".batch"
+
+// A DA layer backed by a directory on the local filesystem, intended for development and testing.
+// Each batch is stored in its own file, named after its height.
+type FileDA struct {
+	dir    string
+	latest uint64
+	// The number of heights which must be built on top of a batch before it is considered final
+	confirmations uint64
+	mu            sync.Mutex
+}
+
+// Opens the file-backed DA layer in the given directory, creating the directory if necessary
+func NewFileDA(dir string, confirmations uint64) (*FileDA, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create the DA directory %v: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the DA directory %v: %w", dir, err)
+	}
+
+	layer := &FileDA{dir: dir, confirmations: confirmations}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, BATCH_FILE_EXTENSION) {
+			continue
+		}
+		height, err := strconv.ParseUint(strings.TrimSuffix(name, BATCH_FILE_EXTENSION), 10, 64)
+		if err != nil {
+			continue
+		}
+		if height > layer.latest {
+			layer.latest = height
+		}
+	}
+	return layer, nil
+}
+
+func (f *FileDA) pathFor(height uint64) string {
+	return filepath.Join(f.dir, fmt.Sprintf("%020d%s", height, BATCH_FILE_EXTENSION))
+}
+
+// Writes the batch to the next height. The file is written to a temporary location and then renamed,
+// so a crash can never leave a partially written batch behind
+func (f *FileDA) PostBatch(batch []byte) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	height := f.latest + 1
+	tmp, err := os.CreateTemp(f.dir, "pending-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(batch); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err = os.Rename(tmp.Name(), f.pathFor(height)); err != nil {
+		return 0, err
+	}
+	// The batch is acknowledged as posted, so the rename must survive a crash too
+	if err = utils.SyncDir(f.dir); err != nil {
+		return 0, err
+	}
+	f.latest = height
+	return height, nil
+}
+
+func (f *FileDA) GetBatches(height uint64) ([][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if height > f.latest {
+		return nil, ERR_HEIGHT_NOT_FOUND
+	}
+	batch, err := os.ReadFile(f.pathFor(height))
+	if os.IsNotExist(err) {
+		return make([][]byte, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return [][]byte{batch}, nil
+}
+
+func (f *FileDA) LatestHeight() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.latest, nil
+}
+
+func (f *FileDA) FinalizedHeight() (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.latest < f.confirmations {
+		return 0, nil
+	}
+	return f.latest - f.confirmations, nil
+}
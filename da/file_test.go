@@ -0,0 +1,69 @@
+package da
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFileDA_postAndGet(t *testing.T) {
+	layer, err := NewFileDA(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewFileDA - expected %v, got %v", nil, err)
+	}
+	for i, batch := range [][]byte{[]byte("first"), []byte("second")} {
+		height, err := layer.PostBatch(batch)
+		if err != nil || height != uint64(i+1) {
+			t.Fatalf("PostBatch - expected height %v, got %v. err %v", i+1, height, err)
+		}
+	}
+	batches, err := layer.GetBatches(2)
+	if err != nil || len(batches) != 1 || !bytes.Equal(batches[0], []byte("second")) {
+		t.Fatalf("GetBatches - expected %s, got %s. err %v", "second", batches, err)
+	}
+	_, err = layer.GetBatches(3)
+	if !errors.Is(err, ERR_HEIGHT_NOT_FOUND) {
+		t.Fatalf("GetBatches - expected %v, got %v", ERR_HEIGHT_NOT_FOUND, err)
+	}
+}
+
+func TestFileDA_finality(t *testing.T) {
+	layer, _ := NewFileDA(t.TempDir(), 2)
+	for i := 0; i < 3; i++ {
+		layer.PostBatch([]byte{byte(i)})
+	}
+	if included, err := IsIncluded(layer, 3); !included || err != nil {
+		t.Fatalf("IsIncluded - expected %v, got %v. err %v", true, included, err)
+	}
+	if included, _ := IsIncluded(layer, 4); included {
+		t.Fatalf("IsIncluded - expected %v, got %v", false, included)
+	}
+	if finalized, _ := IsFinalized(layer, 1); !finalized {
+		t.Fatalf("IsFinalized - expected %v, got %v", true, finalized)
+	}
+	if finalized, _ := IsFinalized(layer, 2); finalized {
+		t.Fatalf("IsFinalized - expected %v, got %v", false, finalized)
+	}
+}
+
+func TestFileDA_reopen(t *testing.T) {
+	dir := t.TempDir()
+	layer, _ := NewFileDA(dir, 0)
+	layer.PostBatch([]byte("first"))
+	layer.PostBatch([]byte("second"))
+	// Unrelated files in the directory are ignored
+	os.WriteFile(dir+"/notes.txt", []byte("hello"), 0644)
+
+	reopened, err := NewFileDA(dir, 0)
+	if err != nil {
+		t.Fatalf("NewFileDA - expected %v, got %v", nil, err)
+	}
+	if latest, _ := reopened.LatestHeight(); latest != 2 {
+		t.Fatalf("LatestHeight - expected %v, got %v", 2, latest)
+	}
+	height, err := reopened.PostBatch([]byte("third"))
+	if err != nil || height != 3 {
+		t.Fatalf("PostBatch - expected height %v, got %v. err %v", 3, height, err)
+	}
+}
@@ -4,8 +4,11 @@ go 1.19
 
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible
+	github.com/gorilla/websocket v1.5.0
 	github.com/ledgerwatch/erigon v1.9.7-0.20220815114851-35c4faa1b41e
 	github.com/ledgerwatch/log/v3 v3.4.1
+	github.com/pelletier/go-toml v1.9.5
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -61,7 +64,6 @@ require (
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/btree v1.1.2 // indirect
 	github.com/google/uuid v1.3.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/grpc-ecosystem/go-grpc-middleware v1.3.0 // indirect
 	github.com/hashicorp/golang-lru v0.5.5-0.20210104140557-80c98217689d // indirect
 	github.com/holiman/uint256 v1.2.0 // indirect
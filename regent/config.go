@@ -0,0 +1,407 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regent/rpc"
+	"regent/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/log/v3"
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v2"
+)
+
+const ENV_PREFIX = "REGENT_"
+const CONFIG_FLAG = "config"
+
+var (
+	ERR_INVALID_CONFIG  = errors.New("invalid configuration")
+	ERR_UNKNOWN_OPTION  = errors.New("unknown configuration option")
+	ERR_UNSUPPORTED_EXT = errors.New("unsupported config file extension. Use .toml, .yaml or .yml")
+)
+
+// Regent's configuration, after validation
+type Config struct {
+	// The URL of the execution client's Engine API
+	EngineUrl string
+	// Certificates used to reach an https or wss Engine API
+	EngineTls rpc.TlsOptions
+	// The file containing the hex-encoded secret used to authenticate with the Engine API. Empty for an ipc endpoint,
+	// which is protected by the permissions of the socket instead
+	JwtSecretPath string
+	GenesisHash   common.Hash
+	FeeRecipient  common.Address
+	// The unix timestamp of the genesis block, at which slot 0 starts
+	GenesisTime uint64
+	SlotTime    time.Duration
+	// How long before the end of a slot the payload is fetched from the execution client
+	BuildDeadline time.Duration
+	LogLevel      log.Lvl
+	// The directory in which Regent stores its state and the file-backed DA layer
+	DataDir string
+	// The number of DA heights which must be built on top of a batch before it is considered final
+	DAConfirmations uint64
+	// The timestamps at which the execution client activates Shanghai and Cancun. If nil, the fork is never activated
+	// and the corresponding Engine API methods are not used
+	ShanghaiTime *uint64
+	CancunTime   *uint64
+	// The configured Engine API policies, which override rpc.DefaultPolicies
+	Policies map[rpc.RpcMethod]rpc.MethodPolicy
+	// When to stop sending requests to an unreachable execution client. A zero FailureThreshold disables the breaker
+	Breaker rpc.BreakerConfig
+	// The address at which metrics are served. Empty if they aren't
+	MetricsAddr string
+}
+
+// A configuration option, which can be set with a flag, an environment variable or a key in the config file
+type option struct {
+	// The name of the flag and of the key in the config file. The environment variable is REGENT_ followed by
+	// the name in upper case with dashes replaced by underscores
+	name         string
+	defaultValue string
+	usage        string
+}
+
+var options = append([]option{
+	{"engine-url", "http://localhost:8551", "URL of the execution client's Engine API. One of http(s)://host:port, ws(s)://host:port or ipc:///path/to/socket"},
+	{"engine-ca-cert", "", "PEM file with the certificate authority of an https or wss engine-url, in addition to the system roots"},
+	{"engine-client-cert", "", "PEM file with the client certificate presented to an https or wss engine-url"},
+	{"engine-client-key", "", "PEM file with the private key of engine-client-cert"},
+	{"jwt-secret", "", "Path to the hex-encoded JWT secret shared with the execution client (default <data-dir>/" + JWT_SECRET_FILENAME + "). Not used with an ipc engine-url, whose socket is protected by its file permissions"},
+	{"genesis-hash", utils.GENESIS_HASH_STRING, "Hash of the rollup's genesis block"},
+	{"fee-recipient", utils.DEV_ADDRESS.Hex(), "Address which receives the fees of the blocks built by this node"},
+	{"genesis-time", "0", "Unix timestamp of the rollup's genesis block, at which the first slot starts"},
+	{"slot-time", "5s", "Time between blocks, as a Go duration"},
+	{"build-deadline", "500ms", "Time before the end of a slot at which the block is fetched from the execution client, which leaves time to post it to DA"},
+	{"log-level", "info", "Log verbosity. One of crit, error, warn, info, debug or trace"},
+	{"data-dir", defaultDataDir(), "Directory in which Regent stores its state and the file-backed DA layer"},
+	{"da-confirmations", "0", "Number of DA heights built on top of a batch before it is considered final"},
+	{"engine-breaker-failures", fmt.Sprint(rpc.DEFAULT_BREAKER.FailureThreshold), "Number of consecutive failures to reach the execution client after which requests fail fast and block production pauses. 0 to never pause"},
+	{"engine-breaker-cooldown", rpc.DEFAULT_BREAKER.Cooldown.String(), "Time to wait before checking whether an unreachable execution client is back, as a Go duration"},
+	{"shanghai-time", "", "Timestamp at which the execution client activates Shanghai. Empty if never"},
+	{"cancun-time", "", "Timestamp at which the execution client activates Cancun. Empty if never"},
+	{"metrics-addr", "", "Address at which metrics are served as JSON at /debug/vars, e.g. localhost:6060. Empty to not serve them"},
+}, policyOptions()...)
+
+// The Engine API methods whose policy can be configured. Every version of a method shares its options
+var policyFamilies = []struct {
+	// The prefix of the options
+	prefix  string
+	methods []rpc.RpcMethod
+}{
+	{"fork-choice", []rpc.RpcMethod{rpc.FORK_CHOICE_UPDATED, rpc.FORK_CHOICE_UPDATED_V2, rpc.FORK_CHOICE_UPDATED_V3}},
+	{"new-payload", []rpc.RpcMethod{rpc.NEW_EXECUTION_PAYLOAD, rpc.NEW_EXECUTION_PAYLOAD_V2, rpc.NEW_EXECUTION_PAYLOAD_V3}},
+	{"get-payload", []rpc.RpcMethod{rpc.GET_EXECUTION_PAYLOAD, rpc.GET_EXECUTION_PAYLOAD_V2, rpc.GET_EXECUTION_PAYLOAD_V3}},
+}
+
+// The options which override the timeout and retries of each policy family. They are empty by default, which keeps
+// the policy in rpc.DefaultPolicies
+func policyOptions() []option {
+	opts := make([]option, 0)
+	for _, family := range policyFamilies {
+		method := strings.TrimSuffix(string(family.methods[0]), "V1")
+		opts = append(opts,
+			option{family.prefix + "-timeout", "", fmt.Sprintf("Time allowed for each attempt at %v, as a Go duration. Empty for the default", method)},
+			option{family.prefix + "-max-attempts", "", fmt.Sprintf("Number of attempts at %v before giving up, or 0 for no limit. Empty for the default", method)},
+			option{family.prefix + "-max-retry-time", "", fmt.Sprintf("Time after which %v is no longer retried, as a Go duration, or 0 for no limit. Empty for the default", method)},
+		)
+	}
+	return opts
+}
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".regent"
+	}
+	return filepath.Join(home, ".regent")
+}
+
+func envName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Builds the configuration from, in increasing order of precedence: defaults, the config file,
+// environment variables and command line flags. Returns flag.ErrHelp if help was requested
+func ParseConfig(args []string, getenv func(string) string, output io.Writer) (*Config, error) {
+	fs := flag.NewFlagSet("regent", flag.ContinueOnError)
+	fs.SetOutput(output)
+	configPath := fs.String(CONFIG_FLAG, "", "Path to an optional TOML or YAML config file")
+	for _, opt := range options {
+		fs.String(opt.name, opt.defaultValue, opt.usage)
+	}
+	fs.Usage = func() { printUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("%w: unexpected arguments %v", ERR_INVALID_CONFIG, fs.Args())
+	}
+
+	values := make(map[string]string)
+	for _, opt := range options {
+		values[opt.name] = opt.defaultValue
+	}
+
+	if *configPath == "" {
+		*configPath = getenv(envName(CONFIG_FLAG))
+	}
+	if *configPath != "" {
+		fileValues, err := readConfigFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileValues {
+			values[name] = value
+		}
+	}
+
+	for _, opt := range options {
+		if value := getenv(envName(opt.name)); value != "" {
+			values[opt.name] = value
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != CONFIG_FLAG {
+			values[f.Name] = f.Value.String()
+		}
+	})
+
+	return buildConfig(values)
+}
+
+// Reads the options in a TOML or YAML config file, chosen by extension
+func readConfigFile(path string) (map[string]string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".toml" && ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("%w: %v", ERR_UNSUPPORTED_EXT, path)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file %v: %w", path, err)
+	}
+
+	raw := make(map[string]interface{})
+	if ext == ".toml" {
+		tree, err := toml.LoadBytes(contents)
+		if err != nil {
+			return nil, fmt.Errorf("%w: could not parse %v: %s", ERR_INVALID_CONFIG, path, err)
+		}
+		raw = tree.ToMap()
+	} else if err := yaml.Unmarshal(contents, &raw); err != nil {
+		return nil, fmt.Errorf("%w: could not parse %v: %s", ERR_INVALID_CONFIG, path, err)
+	}
+
+	values := make(map[string]string)
+	for key, value := range raw {
+		if !isOption(key) {
+			return nil, fmt.Errorf("%w in %v: %v", ERR_UNKNOWN_OPTION, path, key)
+		}
+		values[key] = fmt.Sprint(value)
+	}
+	return values, nil
+}
+
+func isOption(name string) bool {
+	for _, opt := range options {
+		if opt.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validates the raw option values and converts them into a Config
+func buildConfig(values map[string]string) (*Config, error) {
+	config := &Config{
+		EngineUrl: values["engine-url"],
+		EngineTls: rpc.TlsOptions{
+			CAFile:   values["engine-ca-cert"],
+			CertFile: values["engine-client-cert"],
+			KeyFile:  values["engine-client-key"],
+		},
+		JwtSecretPath: values["jwt-secret"],
+		DataDir:       values["data-dir"],
+		MetricsAddr:   values["metrics-addr"],
+	}
+	invalid := func(name string, reason string) error {
+		return fmt.Errorf("%w: %v=%q %s", ERR_INVALID_CONFIG, name, values[name], reason)
+	}
+
+	if err := rpc.ValidateEndpoint(config.EngineUrl); err != nil {
+		return nil, invalid("engine-url", "is not an http, https, ws, wss or ipc URL")
+	}
+	encrypted := strings.HasPrefix(config.EngineUrl, "https://") || strings.HasPrefix(config.EngineUrl, "wss://")
+	if config.EngineTls != (rpc.TlsOptions{}) && !encrypted {
+		return nil, invalid("engine-url", "must use https or wss when engine certificates are configured")
+	}
+	if (config.EngineTls.CertFile == "") != (config.EngineTls.KeyFile == "") {
+		return nil, invalid("engine-client-key", "must be set together with engine-client-cert")
+	}
+
+	if config.DataDir == "" {
+		return nil, invalid("data-dir", "must not be empty")
+	}
+	// Execution clients don't authenticate requests on their IPC socket, so no JWT is sent over it
+	ipc := strings.HasPrefix(config.EngineUrl, rpc.IPC_SCHEME+":")
+	if ipc && config.JwtSecretPath != "" {
+		return nil, invalid("jwt-secret", "must not be set with an ipc engine-url, which is protected by the permissions of the socket")
+	}
+	if config.JwtSecretPath == "" && !ipc {
+		config.JwtSecretPath = filepath.Join(config.DataDir, JWT_SECRET_FILENAME)
+	}
+
+	genesis := values["genesis-hash"]
+	if len(strings.TrimPrefix(genesis, "0x")) != 2*common.HashLength || !isHex(strings.TrimPrefix(genesis, "0x")) {
+		return nil, invalid("genesis-hash", "is not a 32 byte hex string")
+	}
+	config.GenesisHash = common.HexToHash(genesis)
+
+	if !common.IsHexAddress(values["fee-recipient"]) {
+		return nil, invalid("fee-recipient", "is not an address")
+	}
+	config.FeeRecipient = common.HexToAddress(values["fee-recipient"])
+
+	var err error
+	config.GenesisTime, err = strconv.ParseUint(values["genesis-time"], 10, 64)
+	if err != nil {
+		return nil, invalid("genesis-time", "is not a unix timestamp")
+	}
+	config.SlotTime, err = time.ParseDuration(values["slot-time"])
+	if err != nil || config.SlotTime < time.Second {
+		return nil, invalid("slot-time", "is not a duration of at least one second")
+	}
+	config.BuildDeadline, err = time.ParseDuration(values["build-deadline"])
+	if err != nil || config.BuildDeadline < 0 || config.BuildDeadline >= config.SlotTime {
+		return nil, invalid("build-deadline", "is not a non-negative duration shorter than slot-time")
+	}
+
+	config.LogLevel, err = parseLogLevel(values["log-level"])
+	if err != nil {
+		return nil, invalid("log-level", "is not a log level")
+	}
+
+	config.DAConfirmations, err = strconv.ParseUint(values["da-confirmations"], 10, 64)
+	if err != nil {
+		return nil, invalid("da-confirmations", "is not a non-negative integer")
+	}
+
+	config.Breaker.FailureThreshold, err = strconv.Atoi(values["engine-breaker-failures"])
+	if err != nil || config.Breaker.FailureThreshold < 0 {
+		return nil, invalid("engine-breaker-failures", "is not a non-negative integer")
+	}
+	config.Breaker.Cooldown, err = time.ParseDuration(values["engine-breaker-cooldown"])
+	if err != nil || config.Breaker.Cooldown <= 0 {
+		return nil, invalid("engine-breaker-cooldown", "is not a positive duration")
+	}
+
+	if config.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsAddr); err != nil {
+			return nil, invalid("metrics-addr", "is not a host:port address")
+		}
+	}
+
+	config.Policies = make(map[rpc.RpcMethod]rpc.MethodPolicy)
+	for _, family := range policyFamilies {
+		timeout, attempts, retryTime := family.prefix+"-timeout", family.prefix+"-max-attempts", family.prefix+"-max-retry-time"
+		if values[timeout] == "" && values[attempts] == "" && values[retryTime] == "" {
+			continue
+		}
+		policy := rpc.DefaultPolicies[family.methods[0]]
+		if values[timeout] != "" {
+			policy.Timeout, err = time.ParseDuration(values[timeout])
+			if err != nil || policy.Timeout <= 0 {
+				return nil, invalid(timeout, "is not a positive duration")
+			}
+		}
+		if values[attempts] != "" || values[retryTime] != "" {
+			// The default backoff is shared, so it is copied rather than changed in place
+			backoff := rpc.DEFAULT_BACKOFF
+			if policy.Backoff != nil {
+				backoff = *policy.Backoff
+			}
+			policy.Backoff = &backoff
+		}
+		if values[attempts] != "" {
+			policy.Backoff.MaxAttempts, err = strconv.Atoi(values[attempts])
+			if err != nil || policy.Backoff.MaxAttempts < 0 {
+				return nil, invalid(attempts, "is not a non-negative integer")
+			}
+		}
+		if values[retryTime] != "" {
+			policy.Backoff.MaxElapsedTime, err = time.ParseDuration(values[retryTime])
+			if err != nil || policy.Backoff.MaxElapsedTime < 0 {
+				return nil, invalid(retryTime, "is not a non-negative duration")
+			}
+		}
+		for _, method := range family.methods {
+			config.Policies[method] = policy
+		}
+	}
+
+	for name, target := range map[string]**uint64{"shanghai-time": &config.ShanghaiTime, "cancun-time": &config.CancunTime} {
+		if values[name] == "" {
+			continue
+		}
+		timestamp, err := strconv.ParseUint(values[name], 10, 64)
+		if err != nil {
+			return nil, invalid(name, "is not a unix timestamp")
+		}
+		*target = &timestamp
+	}
+	if config.CancunTime != nil && (config.ShanghaiTime == nil || *config.CancunTime < *config.ShanghaiTime) {
+		return nil, invalid("cancun-time", "must not be before shanghai-time")
+	}
+	return config, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a log level. "trace" is accepted in addition to the levels understood by log.LvlFromString
+func parseLogLevel(level string) (log.Lvl, error) {
+	if strings.ToLower(level) == "trace" {
+		return log.LvlTrace, nil
+	}
+	return log.LvlFromString(level)
+}
+
+func printUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: regent [flags]\n\n")
+	fmt.Fprintf(out, "Regent is a consensus client which drives an execution client through the Engine API.\n\n")
+	fmt.Fprintf(out, "Every option can be set with a flag, an environment variable or a key in the config file.\n")
+	fmt.Fprintf(out, "Flags take precedence over environment variables, which take precedence over the config file.\n")
+	fmt.Fprintf(out, "Config file keys are the flag names, e.g. `slot-time = \"2s\"` in TOML or `slot-time: 2s` in YAML.\n\n")
+	fmt.Fprintf(out, "Options:\n")
+
+	names := make([]string, 0)
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		fmt.Fprintf(out, "  --%s\n", f.Name)
+		fmt.Fprintf(out, "        %s\n", f.Usage)
+		fmt.Fprintf(out, "        env: %s", envName(f.Name))
+		if f.DefValue != "" {
+			fmt.Fprintf(out, ", default: %s", f.DefValue)
+		}
+		fmt.Fprintf(out, "\n")
+	}
+}
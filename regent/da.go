@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regent/rpc"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// A block as it is posted to the DA layer. It contains everything needed to replay the block into an execution client
+type DABlock struct {
+	Payload               *rpc.ExecutionPayloadV3 `json:"payload"`
+	VersionedHashes       []common.Hash           `json:"versionedHashes"`
+	ParentBeaconBlockRoot common.Hash             `json:"parentBeaconBlockRoot"`
+}
+
+// Posts the block to the DA layer, retrying until the post is acknowledged or ctx is cancelled.
+// Returns the DA height at which the block was included
+func (r *Regent) postBlock(ctx context.Context, block *DABlock) (uint64, error) {
+	batch, err := json.Marshal(block)
+	if err != nil {
+		return 0, fmt.Errorf("could not encode block %v for the DA layer: %w", block.Payload.BlockHash, err)
+	}
+
+	retries := rpc.InfiniteRetryStrategy{}
+	for {
+		height, err := r.DA.PostBatch(batch)
+		if err == nil {
+			r.LastPostedHeight = height
+			return height, nil
+		}
+		log.Warn("Error posting block to the DA layer. Retrying.", "blockhash", block.Payload.BlockHash, "err", err)
+		if err := rpc.Sleep(ctx, r.clock(), retries.Next()); err != nil {
+			return 0, err
+		}
+	}
+}
@@ -1,40 +1,55 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
-	"regent/utils"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"github.com/ledgerwatch/erigon/common"
 	"github.com/ledgerwatch/log/v3"
 )
 
-const DEFAULT_ERIGON_DATADIR = "/Users/prestonevans/sovereign"
 const JWT_SECRET_FILENAME = "jwt.hex"
-
-var ErigonDatadir = DEFAULT_ERIGON_DATADIR
-var EngineRpcPort string = "8551"
+const DA_DIRNAME = "da"
 
 func main() {
-	log.Root().SetHandler(log.LvlFilterHandler(log.LvlInfo, log.StderrHandler))
-
-	regent, err := Initialize()
+	config, err := ParseConfig(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
-		log.Crit("Fatal error attempting to start app", "err", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	log.Root().SetHandler(log.LvlFilterHandler(config.LogLevel, log.StderrHandler))
+
+	// Stop cleanly on Ctrl-C or SIGTERM, abandoning any in-flight Engine API calls
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Finalize the genesis block and start the building process
-	err = regent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	regent, err := Initialize(ctx, config)
 	if err != nil {
-		log.Crit("Could not finalize genesis block", "err", err)
+		log.Crit("Fatal error attempting to start app", "err", err)
 		os.Exit(1)
 	}
-	// Wait for one second to ensure that the next payload builds with a future timestamp
-	time.Sleep(time.Second)
 
-	err = regent.run()
-	if err != nil {
+	if config.MetricsAddr != "" {
+		addr, err := serveMetrics(ctx, config.MetricsAddr)
+		if err != nil {
+			log.Crit("Unable to serve metrics", "addr", config.MetricsAddr, "err", err)
+			os.Exit(1)
+		}
+		log.Info("Serving metrics", "url", fmt.Sprintf("http://%v/debug/vars", addr))
+	}
+
+	// Sync the chain from the stored head (or genesis). Once synced, the run loop starts building on top of the DA tip
+	err = regent.run(ctx)
+	regent.EngineRpc.Close()
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Crit("Fatal error in the consensus loop", "err", err)
 		os.Exit(1)
 	}
 
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// The build metrics of the node, which serveMetrics publishes at /debug/vars
+var BuildVars = expvar.NewMap("regent_build")
+
+// Statistics about the payloads built by this node, which show whether the build deadline leaves the execution client
+// enough time to fill its blocks
+type BuildMetrics struct {
+	Payloads     uint64
+	Transactions uint64
+	GasUsed      uint64
+	// The total time between starting the builder and fetching the payload
+	BuildTime time.Duration
+	// If set, the counters and the latest payload's figures are published there too, so they can be scraped
+	Vars *expvar.Map
+}
+
+// Records a payload fetched from the execution client
+func (m *BuildMetrics) Record(transactions int, gasUsed uint64, gasLimit uint64, buildTime time.Duration) {
+	m.Payloads++
+	m.Transactions += uint64(transactions)
+	m.GasUsed += gasUsed
+	m.BuildTime += buildTime
+	log.Info("Payload built", "txs", transactions, "gasUsed", gasUsed, "gasLimit", gasLimit, "buildTime", buildTime,
+		"avgTxs", m.AverageTransactions(), "avgGasPerSecond", m.GasPerSecond())
+	if m.Vars == nil {
+		return
+	}
+	// Counters only ever grow
+	m.Vars.Add("payloads", 1)
+	m.Vars.Add("transactions", int64(transactions))
+	m.Vars.Add("gasUsed", int64(gasUsed))
+	m.Vars.Add("buildTimeMs", buildTime.Milliseconds())
+	// Gauges describe the latest payload, or the payloads so far
+	setInt(m.Vars, "lastTransactions", int64(transactions))
+	setInt(m.Vars, "lastGasUsed", int64(gasUsed))
+	setInt(m.Vars, "lastGasLimit", int64(gasLimit))
+	setInt(m.Vars, "lastBuildTimeMs", buildTime.Milliseconds())
+	setFloat(m.Vars, "avgTransactions", m.AverageTransactions())
+	setFloat(m.Vars, "gasPerSecond", m.GasPerSecond())
+}
+
+func setInt(vars *expvar.Map, key string, value int64) {
+	v := new(expvar.Int)
+	v.Set(value)
+	vars.Set(key, v)
+}
+
+func setFloat(vars *expvar.Map, key string, value float64) {
+	v := new(expvar.Float)
+	v.Set(value)
+	vars.Set(key, v)
+}
+
+// The average number of transactions in a payload
+func (m *BuildMetrics) AverageTransactions() float64 {
+	if m.Payloads == 0 {
+		return 0
+	}
+	return float64(m.Transactions) / float64(m.Payloads)
+}
+
+// The gas included per second spent building
+func (m *BuildMetrics) GasPerSecond() float64 {
+	if m.BuildTime <= 0 {
+		return 0
+	}
+	return float64(m.GasUsed) / m.BuildTime.Seconds()
+}
+
+// Serves the published metrics as JSON at /debug/vars on the given address until ctx is cancelled.
+// Returns the address it listens on, which differs from addr if addr has port 0
+func serveMetrics(ctx context.Context, addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("The metrics server stopped", "addr", listener.Addr(), "err", err)
+		}
+	}()
+	return listener.Addr(), nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regent/rpc"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// How long the main loop waits before retrying a step which failed
+var RetryInterval = time.Second
+
+// How the main loop recovers from an error
+type Recovery int
+
+const (
+	// The failure is expected to be transient, so the step is tried again after RetryInterval
+	RECOVERY_RETRY Recovery = iota
+	// Regent and the execution client disagree about the chain or the block being built, so Regent re-enters the
+	// syncing loop, which replays the DA layer and restarts the builder
+	RECOVERY_RESYNC
+	// Regent can't make progress without an operator, e.g. because of a bug or an incompatible execution client.
+	// The main loop stops and returns the error
+	RECOVERY_FATAL
+)
+
+func (r Recovery) String() string {
+	switch r {
+	case RECOVERY_RETRY:
+		return "retry"
+	case RECOVERY_RESYNC:
+		return "resync"
+	case RECOVERY_FATAL:
+		return "fatal"
+	}
+	return fmt.Sprintf("unknown recovery %d", r)
+}
+
+// Errors which indicate a bug in Regent or the execution client, or an execution client which can't be used
+var fatalErrors = []error{
+	ERR_INVALID_PAYLOAD,
+	ERR_INVALID_PAYLOAD_STATUS,
+	rpc.ERR_PARSE_ERROR,
+	rpc.ERR_INVALID_REQUEST,
+	rpc.ERR_INVALID_PARAMS,
+}
+
+// The messages of rpc errors which are fatal
+var fatalRpcErrors = []string{
+	rpc.ERR_MARSHALLING_FAILED,
+	rpc.ERR_REQUEST_CREATION_FAILED,
+	rpc.ERR_TOKEN_STRING_RETRIEVAL_FAILED,
+	rpc.ERR_NO_COMPATIBLE_METHOD,
+}
+
+// Errors after which the execution client's view of the chain, or of the block being built, can't be trusted
+var resyncErrors = []error{
+	ERR_FORKCHOICE_NOT_UPDATED,
+	ERR_PAYLOAD_NOT_BUILT,
+	ERR_PAYLOAD_REJECTED,
+	ERR_EXECUTION_CLIENT_SYNCING,
+	ERR_PAYLOAD_ACCEPTED,
+	rpc.ERR_UNKNOWN_PAYLOAD,
+	rpc.ERR_INVALID_FORKCHOICE_STATE,
+	rpc.ERR_UNSUPPORTED_FORK,
+	rpc.ERR_METHOD_NOT_FOUND,
+}
+
+// Classifies an error returned by a step of the main loop. Errors which aren't known to require a resync, or to be
+// fatal, are retried
+func classify(err error) Recovery {
+	for _, fatal := range fatalErrors {
+		if errors.Is(err, fatal) {
+			return RECOVERY_FATAL
+		}
+	}
+	for _, msg := range fatalRpcErrors {
+		if errors.Is(err, errors.New(msg)) {
+			return RECOVERY_FATAL
+		}
+	}
+	for _, resync := range resyncErrors {
+		if errors.Is(err, resync) {
+			return RECOVERY_RESYNC
+		}
+	}
+	return RECOVERY_RETRY
+}
+
+// Applies the recovery policy to an error from a step of the main loop. Returns the error if it is fatal
+func (r *Regent) handleError(ctx context.Context, err error) error {
+	// A cancelled step is not a failure. The loop stops at the start of the next iteration
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+	recovery := classify(err)
+	if recovery != RECOVERY_FATAL && (errors.Is(err, rpc.ERR_UNSUPPORTED_FORK) || errors.Is(err, rpc.ERR_METHOD_NOT_FOUND)) {
+		// The execution client may have been upgraded or replaced, so the negotiated methods are out of date
+		log.Warn("The execution client rejected the Engine API method. Renegotiating capabilities.", "err", err)
+		if negotiateErr := r.EngineRpc.NegotiateCapabilities(ctx); negotiateErr != nil && ctx.Err() == nil {
+			if classify(negotiateErr) == RECOVERY_FATAL {
+				return negotiateErr
+			}
+			log.Warn("Unable to renegotiate capabilities", "err", negotiateErr)
+		}
+	}
+
+	switch recovery {
+	case RECOVERY_FATAL:
+		log.Error("Unrecoverable error in the consensus loop", "mode", r.Mode, "err", err)
+		return err
+	case RECOVERY_RESYNC:
+		log.Warn("Re-entering the syncing loop", "mode", r.Mode, "err", err)
+		// Don't hammer an execution client which keeps failing while syncing
+		if r.Mode == MODE_SYNCING {
+			rpc.Sleep(ctx, r.clock(), RetryInterval)
+		}
+		r.Mode = MODE_SYNCING
+	default:
+		log.Warn("Retrying after an error", "mode", r.Mode, "retryIn", RetryInterval, "err", err)
+		rpc.Sleep(ctx, r.clock(), RetryInterval)
+	}
+	return nil
+}
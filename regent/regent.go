@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"path"
+	"regent/da"
 	"regent/rpc"
 	"regent/rpc/jwt"
+	"regent/utils"
 	"time"
 
 	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
@@ -25,8 +28,24 @@ var (
 	ERR_FORKCHOICE_NOT_UPDATED = errors.New("the fork choice could not be updated")
 	// Test against this error when looking for PayloadBuildErrors
 	ERR_PAYLOAD_NOT_BUILT = errors.New("the execution client was unable to build a valid payload")
+	ERR_PAYLOAD_REJECTED  = errors.New("the execution client rejected the payload it built")
+	// The execution client checked the block hash of the payload, but has not validated it yet
+	ERR_PAYLOAD_ACCEPTED   = errors.New("the execution client accepted the payload without validating it")
+	ERR_INVALID_BLOCK_HASH = errors.New("the block hash of the payload does not match its contents")
 )
 
+// How long the execution client is given to build a replacement for a payload it no longer knows
+var PayloadRebuildTime = 500 * time.Millisecond
+
+// The number of times an unknown payload is rebuilt before Regent gives up and re-enters the syncing loop
+const MAX_PAYLOAD_REBUILDS = 2
+
+// How long to wait before sending a payload which the execution client ACCEPTED without validating it again
+var PayloadRecheckInterval = 500 * time.Millisecond
+
+// The number of times an ACCEPTED payload is sent again before Regent gives up and re-enters the syncing loop
+const MAX_PAYLOAD_RECHECKS = 3
+
 type ForkChoiceUpdateError struct {
 	reason error
 }
@@ -63,78 +82,333 @@ func (e *PayloadBuildError) Unwrap() error {
 	return e.reason
 }
 
+// The execution client found a payload to be invalid. InvalidPayloadErrors match ERR_INVALID_PAYLOAD
+type InvalidPayloadError struct {
+	BlockHash common.Hash
+	// The latest valid ancestor of the payload, or nil if the execution client doesn't know it
+	LatestValidHash *common.Hash
+	ValidationError string
+}
+
+func (e *InvalidPayloadError) Error() string {
+	latestValid := "unknown"
+	if e.LatestValidHash != nil {
+		latestValid = e.LatestValidHash.Hex()
+	}
+	return fmt.Sprintf("%s: block %v is invalid (%s). latest valid ancestor: %s", ERR_INVALID_PAYLOAD, e.BlockHash, e.ValidationError, latestValid)
+}
+
+func (e *InvalidPayloadError) Is(err error) bool {
+	return errors.Is(err, ERR_INVALID_PAYLOAD)
+}
+
 type Regent struct {
-	CurrentHead        common.Hash
-	NextPayloadId      string
-	EngineRpc          rpc.Client
-	BeneficiaryAddress common.Address
+	CurrentHead       common.Hash
+	CurrentHeadNumber uint64
+	NextPayloadId     string
+	// The attributes of the payload currently being built. The timestamp determines the Engine API version used to fetch it
+	NextPayloadAttributes *rpc.PayloadAttributesV3
+	EngineRpc             rpc.Client
+	BeneficiaryAddress    common.Address
+	GenesisHash           common.Hash
+	// Divides time into the slots in which blocks are built, and provides their timestamps
+	Slots *SlotClock
+	// The slot of the payload currently being built
+	NextSlot uint64
+	// How long before the end of a slot the payload is fetched, which leaves time to post it to DA
+	BuildDeadline time.Duration
+	// When the execution client started building the current payload
+	BuildStart time.Time
+	Metrics    BuildMetrics
+	// The timestamp of the latest block built or replayed. The next block must have a later one
+	LatestTimestamp uint64
+	DA              da.DataAvailability
+	// The latest block included in the DA layer
+	SafeBlock BlockRef
+	// The latest block finalized by the DA layer
+	FinalizedBlock BlockRef
+	// Safe blocks which are waiting for DA finality, in order of DA height
+	PendingFinality []PendingBlock
+	// The DA height of the most recent block posted by this node
+	LastPostedHeight uint64
+	// The DA height up to which all blocks have been applied to the execution client
+	SyncedHeight uint64
+	// Replayed blocks which the execution client has yet to validate, in order of DA height. They only become the
+	// head, and safe, once they have been validated
+	Unvalidated []PendingBlock
+	Mode        Mode
+	// Persists the consensus state across restarts. If nil, the state is kept in memory only
+	Store *StateStore
+	// The clock the main loop reads and waits on. If nil, the wall clock is used
+	Clock utils.Clock
 }
 
-func Initialize() (*Regent, error) {
-	r := &Regent{}
-	r.EngineRpc = rpc.NewClient(EngineRpcPort)
-	token, err := jwt.FromSecretFile(path.Join(ErigonDatadir, JWT_SECRET_FILENAME))
+func Initialize(ctx context.Context, config *Config) (*Regent, error) {
+	r := &Regent{
+		BeneficiaryAddress: config.FeeRecipient,
+		GenesisHash:        config.GenesisHash,
+		Clock:              utils.SystemClock,
+		Slots:              NewSlotClock(config.GenesisTime, config.SlotTime, utils.SystemClock),
+		BuildDeadline:      config.BuildDeadline,
+		Metrics:            BuildMetrics{Vars: BuildVars},
+	}
+	var err error
+	r.EngineRpc, err = rpc.NewClientFromUrl(config.EngineUrl, &config.EngineTls)
+	if err != nil {
+		return nil, err
+	}
+	r.EngineRpc.Forks.ShanghaiTime = config.ShanghaiTime
+	r.EngineRpc.Forks.CancunTime = config.CancunTime
+	for method, policy := range config.Policies {
+		r.EngineRpc.SetPolicy(method, policy)
+	}
+	if config.Breaker.FailureThreshold > 0 {
+		r.EngineRpc.SetBreaker(rpc.NewCircuitBreaker(config.Breaker))
+	}
+	if config.JwtSecretPath != "" {
+		token, err := jwt.FromSecretFile(config.JwtSecretPath)
+		if err != nil {
+			return nil, err
+		}
+		r.EngineRpc.SetAuthToken(token)
+	} else {
+		log.Info("Not authenticating with a JWT, since access to the IPC socket is controlled by its file permissions", "engineUrl", config.EngineUrl)
+	}
+
+	r.DA, err = da.NewFileDA(path.Join(config.DataDir, DA_DIRNAME), config.DAConfirmations)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Store = NewStateStore(path.Join(config.DataDir, STATE_FILENAME))
+	err = r.restoreState()
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail fast if the execution client can't speak the Engine API versions required by the fork schedule
+	err = r.EngineRpc.NegotiateCapabilities(ctx)
 	if err != nil {
 		return nil, err
 	}
-	r.EngineRpc.SetAuthToken(token)
 	return r, nil
 }
 
+func (r *Regent) clock() utils.Clock {
+	if r.Clock == nil {
+		return utils.SystemClock
+	}
+	return r.Clock
+}
+
 func (r *Regent) SetCurrentHead(newHead common.Hash) {
 	r.CurrentHead = newHead
 }
 
-// TODO: The main event loop will eventually consist of the following steps:
+// The main event loop consists of the following steps:
 //  1. Sync the consensus client (by downloading the latest block(s) from DA)
 //  2. Send the hash of the latest block to the execution client. If the client was previously done syncing,
 //     and it is our turn to sequence include PayloadAttributes. Otherwise, GOTO 1
-//  3. Wait for block to build.
+//  3. Wait for block to build until the build deadline of the slot.
 //  4. Fetch block from execution client.
 //  5. Post block (+ optional proof) to DA
 //
-// For now, though we assume that...
-//
-//	The consensus client is always synced
-//	It's always our turn to produce a block
-//	DA happens by magic.
-//
-// This lets us use the following simplified loop.
-func (r *Regent) run() error {
-	log.Info("Starting block production loop")
+// For now, though we assume that it's always our turn to produce a block once we're synced.
+// The loop runs until ctx is cancelled, and then returns ctx.Err()
+func (r *Regent) run(ctx context.Context) error {
+	log.Info("Starting consensus loop")
 
+	// Whether the loop is waiting for the execution client to become reachable
+	paused := false
 	for {
-		// Wait for next slot
-		// TODO: This will eventually be a wait on the p2p network. For now, sleep to avoid a busy loop
-		log.Info("Waiting for next slot")
-		time.Sleep(5 * time.Second)
-		log.Info("Done waiting")
-
-		// TODO: don't bother getting a payload when this node isn't the sequencer
-		payload, err := r.EngineRpc.GetPayload(r.NextPayloadId)
-		log.Info("Getting next execution payload")
-		if err != nil {
-			log.Crit("encountered an error attempting retrive the next execution payload", "err", err)
+		if ctx.Err() != nil {
+			log.Info("Stopping consensus loop", "reason", ctx.Err())
+			return ctx.Err()
+		}
+		// Every request would fail while the breaker is open, so there is no point in trying to make progress.
+		// Once the cooldown has passed, the first request of the next iteration checks whether the execution client is back.
+		// The execution client may have lost the payload it was building, so the loop resumes by syncing and restarting the builder
+		if wait := r.EngineRpc.Breaker().RetryAfter(); wait > 0 {
+			if !paused {
+				log.Warn("Pausing block production until the execution client is reachable", "retryIn", wait)
+				paused = true
+			}
+			r.Mode = MODE_SYNCING
+			rpc.Sleep(ctx, r.clock(), wait)
+			continue
+		}
+		if paused && r.EngineRpc.Breaker().State() == rpc.BREAKER_CLOSED {
+			log.Info("Resuming now that the execution client is reachable")
+			paused = false
+		}
+		var err error
+		switch r.Mode {
+		case MODE_SYNCING:
+			err = r.syncAndStartBuilder(ctx)
+		case MODE_PRODUCING:
+			err = r.produceBlock(ctx)
+		}
+		if err := r.handleError(ctx, err); err != nil {
+			return err
+		}
+	}
+}
+
+// Applies the blocks in the DA layer and starts building on top of the latest one
+func (r *Regent) syncAndStartBuilder(ctx context.Context) error {
+	if err := r.sync(ctx); err != nil {
+		return fmt.Errorf("unable to sync from the DA layer: %w", err)
+	}
+	// TODO: Only start the builder when this node will be sequencer
+	if err := r.ExtendChainAndStartBuilder(ctx, r.CurrentHead, r.BeneficiaryAddress); err != nil {
+		return fmt.Errorf("unable to start the block builder after syncing: %w", err)
+	}
+	log.Info("Done syncing. Switching to block production", "head", r.CurrentHead, "daHeight", r.SyncedHeight)
+	r.Mode = MODE_PRODUCING
+	return nil
+}
+
+// Builds a block on top of the current head, posts it to DA and starts building the next one
+func (r *Regent) produceBlock(ctx context.Context) error {
+	// The builder started at the start of the slot. Give it as much time as possible while leaving time to post to DA
+	// TODO: This will eventually be a wait on the p2p network
+	deadline := r.Slots.Deadline(r.NextSlot, r.BuildDeadline)
+	log.Info("Waiting for the build deadline", "slot", r.NextSlot, "deadline", deadline)
+	if err := r.Slots.WaitUntil(ctx, deadline); err != nil {
+		return err
+	}
+	log.Info("Done waiting", "slot", r.NextSlot)
+
+	// If another node has posted to DA, our head is stale
+	if behind, err := r.isBehindDA(); err != nil || behind {
+		log.Info("The DA layer is ahead of the current head. Re-entering the syncing loop.", "daHeight", r.SyncedHeight, "err", err)
+		r.Mode = MODE_SYNCING
+		return nil
+	}
+
+	// TODO: don't bother getting a payload when this node isn't the sequencer
+	log.Info("Getting next execution payload")
+	result, err := r.getPayload(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get the next execution payload: %w", err)
+	}
+	payload := result.ExecutionPayload
+	r.Metrics.Record(len(payload.Transactions), uint64(payload.GasUsed), uint64(payload.GasLimit), r.clock().Now().Sub(r.BuildStart))
+
+	// TODO: don't bother sending the payload to the sequencer when this node isn't the sequencer
+	log.Info("Sending next payload to execution client", "blockhash", payload.BlockHash)
+	versionedHashes := result.BlobsBundle.VersionedHashes()
+	// The head only advances to a block which the execution client has validated
+	var invalid *InvalidPayloadError
+	err = r.sendOwnPayload(ctx, payload, versionedHashes)
+	switch {
+	case errors.Is(err, ERR_INVALID_BLOCK_HASH):
+		// The payload is corrupt. It is dropped, and the next attempt fetches a new one built on the current head
+		if err := r.ExtendChainAndStartBuilder(ctx, r.CurrentHead, r.BeneficiaryAddress); err != nil {
+			return fmt.Errorf("unable to rebuild payload %v: %w", payload.BlockHash, err)
 		}
+		return fmt.Errorf("dropped payload %v: %w", payload.BlockHash, err)
+	case errors.As(err, &invalid) && payload.ParentHash == r.CurrentHead:
+		// The payload was built on the head, which the execution client has validated, so only the new block can be
+		// invalid, whatever the execution client reports as its latest valid ancestor. It hasn't been posted to DA, so
+		// it is dropped and the builder restarted
+		return fmt.Errorf("%w: %v", ERR_PAYLOAD_REJECTED, err)
+	case invalid != nil:
+		// The execution client built the payload on another head, so it and Regent disagree about the chain
+		return fmt.Errorf("payload %v was built on %v rather than the head %v: %w", payload.BlockHash, payload.ParentHash, r.CurrentHead, err)
+	case err != nil:
+		return fmt.Errorf("the execution client did not validate payload %v: %w", payload.BlockHash, err)
+	}
+	r.observeTimestamp(uint64(payload.Timestamp))
+
+	// Don't advance the chain until the block is available to other nodes
+	log.Info("Posting payload to DA", "blockhash", payload.BlockHash)
+	height, err := r.postBlock(ctx, &DABlock{
+		Payload:               payload,
+		VersionedHashes:       versionedHashes,
+		ParentBeaconBlockRoot: r.NextPayloadAttributes.ParentBeaconBlockRoot,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to post payload %v to DA: %w", payload.BlockHash, err)
+	}
+	log.Info("Payload posted to DA", "blockhash", payload.BlockHash, "height", height)
+	r.markSafe(BlockRef{Hash: payload.BlockHash, Number: uint64(payload.BlockNumber)}, height)
+
+	// TODO: Only start the builder when this node will be sequencer
+	log.Info("Updating head", "blockhash", payload.BlockHash)
+	err = r.ExtendChainAndStartBuilder(ctx, payload.BlockHash, r.BeneficiaryAddress)
+	if errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) {
+		// The block is in the DA layer, so syncing applies it
+		return fmt.Errorf("unable to extend the chain with %v: %w", payload.BlockHash, err)
+	}
+	// Our own block has been applied by the execution client, so there is nothing to sync at this height
+	r.SyncedHeight = height
+	if err != nil {
+		return fmt.Errorf("unable to start building on top of %v: %w", payload.BlockHash, err)
+	}
+	return nil
+}
 
-		// TODO: don't bother sending the payload to the sequencer when this node isn't the sequencer
-		log.Info("Sending next payload to execution client", "blockhash", payload.BlockHash)
-		_, err = r.EngineRpc.SendExecutionPayload(payload)
+// Sends a payload built by this node to the execution client, and checks that it was validated. A payload which is
+// ACCEPTED without being validated, e.g. because the execution client is still processing its parent, is sent again
+// after PayloadRecheckInterval. The newPayload policy is patient enough for sync, so the execution client is only
+// given a slot to validate the payload, after which the main loop moves on
+func (r *Regent) sendOwnPayload(ctx context.Context, payload *rpc.ExecutionPayloadV3, versionedHashes []common.Hash) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Slots.SlotTime())
+	defer cancel()
+	for rechecks := 0; ; rechecks++ {
+		status, err := r.EngineRpc.SendExecutionPayload(ctx, payload, versionedHashes, r.NextPayloadAttributes.ParentBeaconBlockRoot)
 		if err != nil {
-			log.Crit("encountered an error attempting to send the payload to the execution client", "err", err)
+			return fmt.Errorf("unable to send payload %v to the execution client: %w", payload.BlockHash, err)
 		}
+		err = validatePayloadStatus(payload.BlockHash, status)
+		if !errors.Is(err, ERR_PAYLOAD_ACCEPTED) || rechecks == MAX_PAYLOAD_RECHECKS {
+			return err
+		}
+		log.Info("The execution client accepted the payload without validating it. Checking again.", "blockhash", payload.BlockHash)
+		if err := rpc.Sleep(ctx, r.clock(), PayloadRecheckInterval); err != nil {
+			return err
+		}
+	}
+}
 
-		// TODO: Only start the builder when this node will be sequencer
-		log.Info("Updating head", "blockhash", payload.BlockHash)
-		err = r.ExtendChainAndStartBuilder(payload.BlockHash, r.BeneficiaryAddress)
-		if errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) {
-			if errors.Is(err, ERR_EXECUTION_CLIENT_SYNCING) {
-				// TODO: re-enter the syncing loop.
-				log.Warn("Unable to extend fork because the execution client is out of sync. Retrying.")
-			}
-			log.Crit("encountered an unrecoverable error attempting to extend the current chain", "err", err)
+// Fetches the payload being built. If the execution client evicted it, or restarted since it started building it,
+// the builder is restarted on the current head with fresh attributes and the new payload is fetched after PayloadRebuildTime
+func (r *Regent) getPayload(ctx context.Context) (*rpc.GetPayloadResult, error) {
+	for rebuilds := 0; ; rebuilds++ {
+		result, err := r.EngineRpc.GetPayload(ctx, r.NextPayloadId, uint64(r.NextPayloadAttributes.Timestamp))
+		if !errors.Is(err, rpc.ERR_UNKNOWN_PAYLOAD) || rebuilds == MAX_PAYLOAD_REBUILDS {
+			return result, err
+		}
+		log.Warn("The execution client does not know the payload being built. Rebuilding it.", "payloadId", r.NextPayloadId, "head", r.CurrentHead)
+		if err := r.ExtendChainAndStartBuilder(ctx, r.CurrentHead, r.BeneficiaryAddress); err != nil {
+			return nil, err
 		}
+		if err := rpc.Sleep(ctx, r.clock(), PayloadRebuildTime); err != nil {
+			return nil, err
+		}
+	}
+}
 
+// Check whether the execution client accepted a payload sent with engine_newPayload. Return an error if not.
+func validatePayloadStatus(blockHash common.Hash, status *rpc.PayloadStatus) error {
+	switch status.Status {
+	case rpc.VALID_PAYLOAD:
+		return nil
+	case rpc.INVALID_PAYLOAD:
+		invalid := &InvalidPayloadError{BlockHash: blockHash, LatestValidHash: status.LatestValidHash}
+		if status.ValidationError != nil {
+			invalid.ValidationError = *status.ValidationError
+		}
+		return invalid
+	case rpc.SYNCING_PAYLOAD:
+		return ERR_EXECUTION_CLIENT_SYNCING
+	case rpc.ACCEPTED_PAYLOAD:
+		return ERR_PAYLOAD_ACCEPTED
+	case rpc.INVALID_BLOCK_HASH_PAYLOAD:
+		return ERR_INVALID_BLOCK_HASH
+	default:
+		return ERR_INVALID_PAYLOAD_STATUS
 	}
 }
 
@@ -143,11 +417,11 @@ func validateForkChoiceUpdate(err error, result *rpc.ForkChoiceUpdatedResult, ne
 	if err != nil {
 		// If the error was an in protocol error, then the error code tells us whether the the fork choice was
 		// updated: "invalid payload attributes" don't prevent a fork choice from being applied, but all other errors do
-		if rpcErr, ok := err.(*rpc.JsonRpcError); ok {
-			switch rpcErr.Code {
-			case rpc.CODE_INVALID_PAYLOAD_ATTRIBUTES:
+		if _, ok := err.(*rpc.JsonRpcError); ok {
+			switch {
+			case errors.Is(err, rpc.ERR_INVALID_PAYLOAD_ATTRIBUTES):
 				return nil
-			case rpc.CODE_INVALID_FORKCHOICE_STATE:
+			case errors.Is(err, rpc.ERR_INVALID_FORKCHOICE_STATE):
 				return ERR_INVALID_FORKCHOICE
 			default:
 				return err
@@ -168,49 +442,82 @@ func validateForkChoiceUpdate(err error, result *rpc.ForkChoiceUpdatedResult, ne
 		return ERR_INVALID_PAYLOAD
 	case rpc.SYNCING_PAYLOAD:
 		return ERR_EXECUTION_CLIENT_SYNCING
+	// The spec only allows these statuses in response to engine_newPayload. If they are returned for the head anyway,
+	// they mean the same as they do for a payload
+	case rpc.ACCEPTED_PAYLOAD:
+		return ERR_PAYLOAD_ACCEPTED
+	case rpc.INVALID_BLOCK_HASH_PAYLOAD:
+		return ERR_INVALID_BLOCK_HASH
 	default:
 		return ERR_INVALID_PAYLOAD_STATUS
 	}
 }
 
-// Add a new block to the chain using engine_forkChoiceUpdated. Re-orgs are impossible,
-// so the last finalized block is just the previous head
-func (r *Regent) ExtendChainAndStartBuilder(newHead common.Hash, suggestedRecipient common.Address) error {
-	return r.tryExtendChainAndStartBuilder(newHead, suggestedRecipient)
-}
-
-// Add a new block to the chain using engine_forkChoiceUpdated. Re-orgs are impossible,
-// so the last finalized block is just the previous head
-func (r *Regent) tryExtendChainAndStartBuilder(newHead common.Hash, suggestedRecipient common.Address) error {
-	// Construct and send the Rpc Message
-	nextState := commands.ForkChoiceState{
-		HeadHash:           newHead,
-		FinalizedBlockHash: r.CurrentHead,
-		SafeBlockHash:      r.CurrentHead,
+// Add a new block to the chain using engine_forkChoiceUpdated. The safe block is the latest block
+// posted to DA, and the finalized block is the latest block finalized by DA
+func (r *Regent) ExtendChainAndStartBuilder(ctx context.Context, newHead common.Hash, suggestedRecipient common.Address) error {
+	// The chain only ever grows one block at a time, so the new head is either the current head or its child
+	newHeadNumber := r.CurrentHeadNumber
+	if newHead != r.CurrentHead {
+		newHeadNumber++
+		// The new block becomes the head straight away, rather than once the next slot starts, so that it can be
+		// queried in the meantime
+		if err := r.updateHead(ctx, newHead, newHeadNumber); err != nil {
+			return err
+		}
 	}
-	result, err := r.EngineRpc.UpdateForkChoiceAndBuildBlock(&nextState, &commands.PayloadAttributes{
-		Timestamp:             hexutil.Uint64(time.Now().Unix()),
-		SuggestedFeeRecipient: suggestedRecipient,
-	})
+	// The block is built for the first slot which hasn't started yet, unless its timestamp wouldn't be later than the parent's.
+	// The builder is started at the start of the slot, so the payload includes the transactions which arrive during it
+	slot := r.Slots.NextSlotAfter(r.LatestTimestamp)
+	if err := r.Slots.WaitForSlot(ctx, slot); err != nil {
+		return err
+	}
+	// Construct and send the Rpc Message. DA may have finalized more blocks while waiting for the slot
+	nextState := r.nextForkChoiceState(newHead)
+	attributes := &rpc.PayloadAttributesV3{
+		PayloadAttributesV2: rpc.PayloadAttributesV2{
+			PayloadAttributes: commands.PayloadAttributes{
+				Timestamp:             hexutil.Uint64(r.Slots.Timestamp(slot)),
+				SuggestedFeeRecipient: suggestedRecipient,
+			},
+			// The rollup has no beacon chain, so there is never anything to withdraw
+			Withdrawals: make([]*rpc.Withdrawal, 0),
+		},
+		// Likewise, there is no beacon block to commit to, so the root is always empty
+		ParentBeaconBlockRoot: common.Hash{},
+	}
+	result, err := r.EngineRpc.UpdateForkChoiceAndBuildBlock(ctx, &nextState, attributes)
 
 	// Verify that the fork choice was updated
 	forkChoiceErr := validateForkChoiceUpdate(err, result, &nextState)
 	if forkChoiceErr != nil {
-		log.Crit(ERR_FORKCHOICE_NOT_UPDATED.Error(), "err", forkChoiceErr)
 		return &ForkChoiceUpdateError{forkChoiceErr}
 	}
 	r.SetCurrentHead(newHead)
+	r.CurrentHeadNumber = newHeadNumber
+	r.commitFinalized(nextState.FinalizedBlockHash)
+	r.saveState()
 
 	// If `err` is not nil but we reached this point, the error must have been "invalid payload attributes".
 	if err != nil {
-		log.Crit(ERR_INVALID_TIMESTAMP.Error(), "err", err, "forkChoiceState", nextState)
+		log.Debug(ERR_INVALID_TIMESTAMP.Error(), "err", err, "forkChoiceState", nextState)
 		return &PayloadBuildError{ERR_INVALID_TIMESTAMP}
 	}
 	// Sanity check that the payload ID looks like a valid DATA[8] object
 	if len(result.PayloadId) != 18 {
-		log.Crit("The execution client returned an invalid payload id", "forkChoiceState", nextState, "response", result)
+		log.Debug("The execution client returned an invalid payload id", "forkChoiceState", nextState, "response", result)
 		return &PayloadBuildError{ERR_INVALID_PAYLOAD_ID}
 	}
 	r.NextPayloadId = result.PayloadId
+	r.NextPayloadAttributes = attributes
+	r.NextSlot = slot
+	r.BuildStart = r.clock().Now()
 	return nil
 }
+
+// Records the timestamp of a block which was added to the chain
+func (r *Regent) observeTimestamp(timestamp uint64) {
+	if timestamp > r.LatestTimestamp {
+		r.LatestTimestamp = timestamp
+	}
+}
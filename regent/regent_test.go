@@ -1,26 +1,54 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"regent/da"
 	"regent/rpc"
 	"regent/utils"
 	"regent/utils/test"
 
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
 	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/log/v3"
 )
 
 var TestRpcClient = rpc.NewClient("8545")
 var TestRegent Regent
 
+// Short slots keep the tests fast. Consecutive slots may share a timestamp, so blocks skip slots to stay strictly later
+var TestSlots = NewSlotClock(0, 10*time.Millisecond, utils.SystemClock)
+
 func init() {
-	TestRpcClient.Endpoint = test.TestServer.URL
+	TestRpcClient.SetEndpoint(test.TestServer.URL)
+	// The tests answer with canned responses, which don't know the id of the request
+	test.TestHandler.SetEchoIds(true)
+	// Sync replays blocks in batches, which the handlers answer one request at a time
+	test.TestHandler.SetSplitBatches(true)
 	rpc.DefaultRetryStrategy = func() rpc.RetryStrategy { return &test.NoRetryStrategy{} }
+	// Methods with their own backoff would otherwise still be retried
+	for method, policy := range rpc.DefaultPolicies {
+		policy.Backoff = nil
+		rpc.DefaultPolicies[method] = policy
+	}
 	TestRegent = Regent{
 		EngineRpc: TestRpcClient,
+		Slots:     TestSlots,
 	}
 }
 
@@ -33,9 +61,9 @@ func TestExtendChainAndStartBuilder_successResponse(t *testing.T) {
 		},
 			PayloadId: "0x0000000000000001",
 		}})
-	test.TestHandler.Response = response
+	test.TestHandler.SetResponse(response)
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if err != nil {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", nil, err)
 	}
@@ -43,9 +71,9 @@ func TestExtendChainAndStartBuilder_successResponse(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_syncingResponse(t *testing.T) {
 	response := `{"result": {"payloadStatus": {"status": "SYNCING", "latestValidHash": null, "validationError": null}, "payloadId": null}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_EXECUTION_CLIENT_SYNCING) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_EXECUTION_CLIENT_SYNCING, err)
 	}
@@ -53,9 +81,9 @@ func TestExtendChainAndStartBuilder_syncingResponse(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_invalidPayloadResponse(t *testing.T) {
 	response := `{"result": {"payloadStatus": {"status": "INVALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_PAYLOAD) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_PAYLOAD, err)
 	}
@@ -63,9 +91,9 @@ func TestExtendChainAndStartBuilder_invalidPayloadResponse(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_invalidPayloadId(t *testing.T) {
 	response := `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_PAYLOAD_ID) || errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_PAYLOAD_ID, err)
 	}
@@ -73,9 +101,9 @@ func TestExtendChainAndStartBuilder_invalidPayloadId(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_valid(t *testing.T) {
 	response := `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if err != nil {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", nil, err)
 	}
@@ -83,9 +111,9 @@ func TestExtendChainAndStartBuilder_valid(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_invalidForkchoice(t *testing.T) {
 	response := `{"error": {"code": -38002, "message": "Invalid forkchoice state"}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_FORKCHOICE) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_FORKCHOICE, err)
 	}
@@ -93,9 +121,9 @@ func TestExtendChainAndStartBuilder_invalidForkchoice(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_noPayloadStatus(t *testing.T) {
 	response := `{"result": {"payloadStatus": null, "payloadId": "0x0000000000000001"}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_PAYLOAD_STATUS) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_PAYLOAD_STATUS, err)
 	}
@@ -103,31 +131,41 @@ func TestExtendChainAndStartBuilder_noPayloadStatus(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_invalidPayloadAttributes(t *testing.T) {
 	response := `{"error": {"code": -38003, "message": "Invalid payload attributes"}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_TIMESTAMP) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) || errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_TIMESTAMP, err)
 	}
 }
 
 func TestExtendChainAndStartBuilder_invalidPayloadStatus(t *testing.T) {
-	response := `{"result": {"payloadStatus": {"status": "INVALID_BLOCK_HASH", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
-	test.TestHandler.Response = []byte(response)
+	response := `{"result": {"payloadStatus": {"status": "MAYBE", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_INVALID_PAYLOAD_STATUS) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_INVALID_PAYLOAD_STATUS, err)
 	}
 }
 
+func TestExtendChainAndStartBuilder_acceptedAndInvalidBlockHash(t *testing.T) {
+	for status, expected := range map[string]error{"ACCEPTED": ERR_PAYLOAD_ACCEPTED, "INVALID_BLOCK_HASH": ERR_INVALID_BLOCK_HASH} {
+		test.TestHandler.SetResponse([]byte(fmt.Sprintf(`{"result": {"payloadStatus": {"status": "%s", "latestValidHash": null, "validationError": null}, "payloadId": null}}`, status)))
+		err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+		if !errors.Is(err, expected) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || errors.Is(err, ERR_INVALID_PAYLOAD_STATUS) {
+			t.Errorf("ExtendChainAndStartBuilder - expected: %v, got: %v", expected, err)
+		}
+	}
+}
+
 func TestExtendChainAndStartBuilder_errorReadingBody(t *testing.T) {
-	test.TestHandler.HandlerFunc = func(resp http.ResponseWriter, req *http.Request) {
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 		test.TestServer.CloseClientConnections()
-	}
-	defer func() { test.TestHandler.HandlerFunc = nil }()
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) || !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_FORKCHOICE_NOT_UPDATED, err)
 	}
@@ -135,10 +173,1179 @@ func TestExtendChainAndStartBuilder_errorReadingBody(t *testing.T) {
 
 func TestExtendChainAndStartBuilder_executionClientError(t *testing.T) {
 	response := `{"error": {"code": -32000, "message": "Generic client error while processing request"}}`
-	test.TestHandler.Response = []byte(response)
+	test.TestHandler.SetResponse([]byte(response))
 
-	err := TestRegent.ExtendChainAndStartBuilder(common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
 	if !errors.Is(err, ERR_PAYLOAD_NOT_BUILT) || !errors.Is(err, ERR_FORKCHOICE_NOT_UPDATED) {
 		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", ERR_FORKCHOICE_NOT_UPDATED, err)
 	}
 }
+
+func TestExtendChainAndStartBuilder_cancunAttributes(t *testing.T) {
+	cancunTime := uint64(0)
+	previousForks := TestRegent.EngineRpc.Forks
+	TestRegent.EngineRpc.Forks = rpc.ForkSchedule{ShanghaiTime: &cancunTime, CancunTime: &cancunTime}
+	defer func() { TestRegent.EngineRpc.Forks = previousForks }()
+	response := `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
+	test.TestHandler.SetResponse([]byte(response))
+
+	err := TestRegent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash(utils.GENESIS_HASH_STRING), utils.DEV_ADDRESS)
+	if err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", nil, err)
+	}
+	if test.TestHandler.LastMethod() != string(rpc.FORK_CHOICE_UPDATED_V3) || !strings.Contains(string(test.TestHandler.LastRequest()), `"parentBeaconBlockRoot"`) {
+		t.Fatalf("ExtendChainAndStartBuilder - expected V3 payload attributes, got: %s", test.TestHandler.LastRequest())
+	}
+	if TestRegent.NextPayloadAttributes == nil || TestRegent.NextPayloadAttributes.Withdrawals == nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected the payload attributes to be recorded, got: %+v", TestRegent.NextPayloadAttributes)
+	}
+}
+
+// A DA layer which rejects the first `failures` posts
+type flakyDA struct {
+	*da.FileDA
+	failures int
+}
+
+func (f *flakyDA) PostBatch(batch []byte) (uint64, error) {
+	if f.failures > 0 {
+		f.failures--
+		return 0, errors.New("DA layer unavailable")
+	}
+	return f.FileDA.PostBatch(batch)
+}
+
+func TestPostBlock_retriesUntilAcknowledged(t *testing.T) {
+	fileDA, _ := da.NewFileDA(t.TempDir(), 0)
+	regent := Regent{DA: &flakyDA{FileDA: fileDA, failures: 1}}
+	payload := &rpc.ExecutionPayloadV3{}
+	payload.BlockHash = common.HexToHash("0x01")
+
+	height, err := regent.postBlock(context.Background(), &DABlock{Payload: payload})
+	if err != nil || height != 1 || regent.LastPostedHeight != 1 {
+		t.Fatalf("postBlock - expected height %v, got %v. err %v", 1, height, err)
+	}
+	batches, _ := fileDA.GetBatches(1)
+	var block DABlock
+	if err := json.Unmarshal(batches[0], &block); err != nil || block.Payload.BlockHash != payload.BlockHash {
+		t.Fatalf("postBlock - expected block %v to be posted, got %s", payload.BlockHash, batches[0])
+	}
+}
+
+func TestPostBlock_stopsWhenCancelled(t *testing.T) {
+	fileDA, _ := da.NewFileDA(t.TempDir(), 0)
+	regent := Regent{DA: &flakyDA{FileDA: fileDA, failures: 1000}}
+	payload := &rpc.ExecutionPayloadV3{}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := regent.postBlock(ctx, &DABlock{Payload: payload})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("postBlock - expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRun_stopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t)}
+	if err := regent.run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("run - expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRun_pausesWhileBreakerOpen(t *testing.T) {
+	server := httptest.NewServer(nil)
+	server.Close()
+	client := rpc.NewClient("8545")
+	client.SetEndpoint(server.URL)
+	client.SetBreaker(rpc.NewCircuitBreaker(rpc.BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}))
+	client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if state := client.Breaker().State(); state != rpc.BREAKER_OPEN {
+		t.Fatalf("State - expected %v, got %v", rpc.BREAKER_OPEN, state)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	regent := Regent{EngineRpc: client, Slots: TestSlots, DA: newTestDA(t), Mode: MODE_PRODUCING}
+	if err := regent.run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("run - expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	// Block production resumes by syncing once the execution client is back
+	if regent.Mode != MODE_SYNCING {
+		t.Fatalf("run - expected mode %v, got %v", MODE_SYNCING, regent.Mode)
+	}
+}
+
+func TestRun_pausesOnClientClock(t *testing.T) {
+	server := httptest.NewServer(nil)
+	server.Close()
+	clock := test.NewFakeClock(time.Unix(1000, 0))
+	client := rpc.NewClient("8545")
+	client.SetEndpoint(server.URL)
+	client.SetClock(clock)
+	client.SetBreaker(rpc.NewCircuitBreaker(rpc.BreakerConfig{FailureThreshold: 1, Cooldown: time.Minute}))
+	client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	regent := Regent{EngineRpc: client, Clock: clock, Slots: NewSlotClock(1000, time.Second, clock), DA: newTestDA(t), Mode: MODE_PRODUCING}
+	if err := regent.run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("run - expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	// The cooldown passes on the fake clock, rather than being waited out in a busy loop
+	if sleeps := clock.Sleeps(); len(sleeps) == 0 || sleeps[0] != time.Minute {
+		t.Fatalf("run - expected to pause for the cooldown of %v, got %v", time.Minute, sleeps)
+	}
+}
+
+func TestProduceBlock_boundsNewPayloadBySlot(t *testing.T) {
+	// Closing the server waits for the slow newPayload, so it can't reach the next test
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request rpc.Request
+		json.NewDecoder(req.Body).Decode(&request)
+		if !strings.HasPrefix(string(request.Method), "engine_newPayload") {
+			payload, _ := json.Marshal(rpc.Response[*commands.ExecutionPayload]{Id: &request.Id, Result: &commands.ExecutionPayload{BlockHash: common.HexToHash("0x01")}})
+			resp.Write(payload)
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+	client := rpc.NewClient("8545")
+	client.SetEndpoint(server.URL)
+	regent := Regent{
+		EngineRpc:             client,
+		Slots:                 TestSlots,
+		DA:                    newTestDA(t),
+		Mode:                  MODE_PRODUCING,
+		NextPayloadId:         "0x0000000000000001",
+		NextPayloadAttributes: &rpc.PayloadAttributesV3{},
+	}
+
+	start := time.Now()
+	err := regent.produceBlock(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 250*time.Millisecond {
+		t.Fatalf("produceBlock - expected %v within a slot, got %v after %v", context.DeadlineExceeded, err, time.Since(start))
+	}
+	if regent.CurrentHead != (common.Hash{}) {
+		t.Fatalf("produceBlock - expected the head not to move, got %v", regent.CurrentHead)
+	}
+}
+
+func TestProduceBlock_unknownPayload(t *testing.T) {
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "error": {"code": -38001, "message": "Unknown payload"}}`))
+	regent := Regent{
+		EngineRpc:             TestRpcClient,
+		Slots:                 TestSlots,
+		DA:                    newTestDA(t),
+		Mode:                  MODE_PRODUCING,
+		NextPayloadId:         "0x0000000000000001",
+		NextPayloadAttributes: &rpc.PayloadAttributesV3{},
+	}
+	err := regent.produceBlock(context.Background())
+	if !errors.Is(err, rpc.ERR_UNKNOWN_PAYLOAD) || classify(err) != RECOVERY_RESYNC {
+		t.Fatalf("produceBlock - expected %v to cause a resync, got %v", rpc.ERR_UNKNOWN_PAYLOAD, err)
+	}
+}
+
+// Posts blocks with the given hashes to a new file-backed DA layer
+func newTestDA(t *testing.T, hashes ...common.Hash) *da.FileDA {
+	fileDA, _ := da.NewFileDA(t.TempDir(), 0)
+	for _, hash := range hashes {
+		payload := &rpc.ExecutionPayloadV3{}
+		payload.BlockHash = hash
+		batch, _ := json.Marshal(&DABlock{Payload: payload})
+		fileDA.PostBatch(batch)
+	}
+	return fileDA
+}
+
+// Replies to engine_newPayload with VALID and to engine_forkchoiceUpdated with the statuses in order,
+// repeating the last status once they run out. Returns a pointer to the list of methods called
+func respondWithForkChoiceStatuses(statuses ...string) *[]string {
+	methods := make([]string, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		method := test.TestHandler.LastMethod()
+		methods = append(methods, method)
+		if strings.HasPrefix(method, "engine_newPayload") {
+			resp.Write([]byte(`{"result": {"status": "VALID", "latestValidHash": null, "validationError": null}}`))
+			return
+		}
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		resp.Write([]byte(fmt.Sprintf(`{"result": {"payloadStatus": {"status": "%s", "latestValidHash": null, "validationError": null}, "payloadId": null}}`, status)))
+	})
+	return &methods
+}
+
+// Simulates an execution client which evicts the payload it is building the first `evictions` times it is fetched.
+// Each fork choice update starts building a payload on its head with a new id, and only the latest one can be fetched.
+// Returns a pointer to the list of methods called
+func simulatePayloadEviction(evictions int) *[]string {
+	methods := make([]string, 0)
+	building := 0
+	var parent common.Hash
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(test.TestHandler.LastRequest(), &request)
+		methods = append(methods, request.Method)
+		switch {
+		case strings.HasPrefix(request.Method, "engine_forkchoiceUpdated") && len(request.Params) < 2:
+			resp.Write([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+		case strings.HasPrefix(request.Method, "engine_forkchoiceUpdated"):
+			building++
+			var state commands.ForkChoiceState
+			json.Unmarshal(request.Params[0], &state)
+			parent = state.HeadHash
+			resp.Write([]byte(fmt.Sprintf(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x%016x"}}`, building)))
+		case strings.HasPrefix(request.Method, "engine_getPayload"):
+			var id string
+			json.Unmarshal(request.Params[0], &id)
+			if evictions > 0 || id != fmt.Sprintf("0x%016x", building) {
+				evictions--
+				resp.Write([]byte(`{"error": {"code": -38001, "message": "Unknown payload"}}`))
+				return
+			}
+			payload, _ := json.Marshal(rpc.Response[*commands.ExecutionPayload]{
+				Result: &commands.ExecutionPayload{BlockHash: common.HexToHash(fmt.Sprintf("0x%x", building)), ParentHash: parent, BlockNumber: 1},
+			})
+			resp.Write(payload)
+		case strings.HasPrefix(request.Method, "engine_newPayload"):
+			resp.Write([]byte(`{"result": {"status": "VALID", "latestValidHash": null, "validationError": null}}`))
+		}
+	})
+	return &methods
+}
+
+// Returns a block producer whose builder has been started on the genesis block
+func newProducingRegent(t *testing.T) *Regent {
+	regent := &Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t), CurrentHead: common.HexToHash(utils.GENESIS_HASH_STRING)}
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), regent.CurrentHead, utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v, got %v", nil, err)
+	}
+	regent.Mode = MODE_PRODUCING
+	return regent
+}
+
+func TestProduceBlock_rebuildsEvictedPayload(t *testing.T) {
+	defer func(previous time.Duration) { PayloadRebuildTime = previous }(PayloadRebuildTime)
+	PayloadRebuildTime = time.Millisecond
+	methods := simulatePayloadEviction(1)
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := newProducingRegent(t)
+
+	if err := regent.produceBlock(context.Background()); err != nil {
+		t.Fatalf("produceBlock - expected %v, got %v", nil, err)
+	}
+	// The new block becomes the head before the builder is started on top of it in the next slot
+	expected := []string{"engine_forkchoiceUpdatedV1", "engine_getPayloadV1", "engine_forkchoiceUpdatedV1", "engine_getPayloadV1", "engine_newPayloadV1", "engine_forkchoiceUpdatedV1", "engine_forkchoiceUpdatedV1"}
+	if fmt.Sprint(*methods) != fmt.Sprint(expected) {
+		t.Fatalf("produceBlock - expected calls %v, got %v", expected, *methods)
+	}
+	// The rebuilt payload is the one which extends the chain
+	if regent.Mode != MODE_PRODUCING || regent.CurrentHead != common.HexToHash("0x02") || regent.CurrentHeadNumber != 1 {
+		t.Fatalf("produceBlock - expected to produce %v at height %v, got %v at height %v in mode %v", common.HexToHash("0x02"), 1, regent.CurrentHead, regent.CurrentHeadNumber, regent.Mode)
+	}
+}
+
+func TestProduceBlock_givesUpRebuilding(t *testing.T) {
+	defer func(previous time.Duration) { PayloadRebuildTime = previous }(PayloadRebuildTime)
+	PayloadRebuildTime = time.Millisecond
+	simulatePayloadEviction(MAX_PAYLOAD_REBUILDS + 1)
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := newProducingRegent(t)
+
+	err := regent.produceBlock(context.Background())
+	if !errors.Is(err, rpc.ERR_UNKNOWN_PAYLOAD) || classify(err) != RECOVERY_RESYNC {
+		t.Fatalf("produceBlock - expected %v to cause a resync, got %v", rpc.ERR_UNKNOWN_PAYLOAD, err)
+	}
+}
+
+func TestProduceBlock_rejectedPayload(t *testing.T) {
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	// Whatever the execution client reports as the latest valid ancestor, the payload was built on the head
+	for _, latestValidHash := range []string{`"` + utils.GENESIS_HASH_STRING + `"`, "null", `"0x0000000000000000000000000000000000000000000000000000000000000bad"`} {
+		simulatePayloadEviction(0)
+		building := test.TestHandler.HandlerFunc()
+		test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if strings.HasPrefix(test.TestHandler.LastMethod(), "engine_newPayload") {
+				resp.Write([]byte(fmt.Sprintf(`{"result": {"status": "INVALID", "latestValidHash": %v, "validationError": "bad state root"}}`, latestValidHash)))
+				return
+			}
+			building(resp, req)
+		})
+		regent := newProducingRegent(t)
+
+		err := regent.produceBlock(context.Background())
+		if !errors.Is(err, ERR_PAYLOAD_REJECTED) || classify(err) != RECOVERY_RESYNC {
+			t.Fatalf("produceBlock - expected %v to cause a resync with latest valid hash %v, got %v", ERR_PAYLOAD_REJECTED, latestValidHash, err)
+		}
+		if regent.CurrentHead != common.HexToHash(utils.GENESIS_HASH_STRING) {
+			t.Fatalf("produceBlock - expected the head to stay at %v, got %v", utils.GENESIS_HASH_STRING, regent.CurrentHead)
+		}
+		if height, _ := regent.DA.LatestHeight(); height != 0 {
+			t.Fatalf("produceBlock - expected nothing to be posted to DA, got height %v", height)
+		}
+	}
+}
+
+// Replies to engine_newPayload with the statuses in order, repeating the last status once they run out, and passes
+// every other request to the current handler. Returns a pointer to the number of engine_newPayload calls
+func respondToNewPayload(statuses ...string) *int {
+	calls := 0
+	next := test.TestHandler.HandlerFunc()
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(test.TestHandler.LastMethod(), "engine_newPayload") {
+			next(resp, req)
+			return
+		}
+		calls++
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		resp.Write([]byte(fmt.Sprintf(`{"result": {"status": "%s", "latestValidHash": null, "validationError": null}}`, status)))
+	})
+	return &calls
+}
+
+func TestProduceBlock_rechecksAcceptedPayload(t *testing.T) {
+	defer func(previous time.Duration) { PayloadRecheckInterval = previous }(PayloadRecheckInterval)
+	PayloadRecheckInterval = time.Millisecond
+	simulatePayloadEviction(0)
+	calls := respondToNewPayload("ACCEPTED", "ACCEPTED", "VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := newProducingRegent(t)
+
+	if err := regent.produceBlock(context.Background()); err != nil {
+		t.Fatalf("produceBlock - expected %v, got %v", nil, err)
+	}
+	if *calls != 3 || regent.CurrentHead != common.HexToHash("0x01") {
+		t.Fatalf("produceBlock - expected the payload to be sent %v times before extending the chain, got %v times and head %v", 3, *calls, regent.CurrentHead)
+	}
+}
+
+func TestProduceBlock_givesUpOnAcceptedPayload(t *testing.T) {
+	defer func(previous time.Duration) { PayloadRecheckInterval = previous }(PayloadRecheckInterval)
+	PayloadRecheckInterval = time.Millisecond
+	simulatePayloadEviction(0)
+	calls := respondToNewPayload("ACCEPTED")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := newProducingRegent(t)
+
+	err := regent.produceBlock(context.Background())
+	if !errors.Is(err, ERR_PAYLOAD_ACCEPTED) || classify(err) != RECOVERY_RESYNC || *calls != MAX_PAYLOAD_RECHECKS+1 {
+		t.Fatalf("produceBlock - expected %v after %v attempts, got %v after %v", ERR_PAYLOAD_ACCEPTED, MAX_PAYLOAD_RECHECKS+1, err, *calls)
+	}
+	if regent.CurrentHead != common.HexToHash(utils.GENESIS_HASH_STRING) {
+		t.Fatalf("produceBlock - expected the head to stay at %v, got %v", utils.GENESIS_HASH_STRING, regent.CurrentHead)
+	}
+}
+
+func TestProduceBlock_dropsInvalidBlockHash(t *testing.T) {
+	simulatePayloadEviction(0)
+	respondToNewPayload("INVALID_BLOCK_HASH")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := newProducingRegent(t)
+	previousPayloadId := regent.NextPayloadId
+
+	err := regent.produceBlock(context.Background())
+	if !errors.Is(err, ERR_INVALID_BLOCK_HASH) || classify(err) != RECOVERY_RETRY {
+		t.Fatalf("produceBlock - expected %v to be retried, got %v", ERR_INVALID_BLOCK_HASH, err)
+	}
+	// The payload is dropped and a new one is built on the same head
+	if regent.CurrentHead != common.HexToHash(utils.GENESIS_HASH_STRING) || regent.NextPayloadId == previousPayloadId {
+		t.Fatalf("produceBlock - expected a new payload on %v, got payload %v on %v", utils.GENESIS_HASH_STRING, regent.NextPayloadId, regent.CurrentHead)
+	}
+	if height, _ := regent.DA.LatestHeight(); height != 0 {
+		t.Fatalf("produceBlock - expected nothing to be posted to DA, got height %v", height)
+	}
+}
+
+func TestSync_skipsInvalidBlockHash(t *testing.T) {
+	respondWithForkChoiceStatuses("VALID")
+	respondToNewPayload("INVALID_BLOCK_HASH", "VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"), common.HexToHash("0x02"))}
+
+	if err := regent.sync(context.Background()); err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	if regent.CurrentHead != common.HexToHash("0x02") || regent.SyncedHeight != 2 {
+		t.Fatalf("sync - expected head %v at height %v, got %v at height %v", common.HexToHash("0x02"), 2, regent.CurrentHead, regent.SyncedHeight)
+	}
+}
+
+func TestSync_acceptedPayload(t *testing.T) {
+	previousInterval := SyncPollInterval
+	SyncPollInterval = time.Millisecond
+	defer func() { SyncPollInterval = previousInterval }()
+	respondWithForkChoiceStatuses("ACCEPTED", "VALID")
+	respondToNewPayload("ACCEPTED")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"))}
+
+	// The block is applied, and the head is polled until it has been validated
+	if err := regent.sync(context.Background()); err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	if regent.CurrentHead != common.HexToHash("0x01") {
+		t.Fatalf("sync - expected head %v, got %v", common.HexToHash("0x01"), regent.CurrentHead)
+	}
+}
+
+func TestSync_replaysBlocksFromDA(t *testing.T) {
+	methods := respondWithForkChoiceStatuses("VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"), common.HexToHash("0x02"))}
+
+	err := regent.sync(context.Background())
+	if err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	if regent.CurrentHead != common.HexToHash("0x02") || regent.SyncedHeight != 2 {
+		t.Fatalf("sync - expected head %v at height %v, got %v at height %v", common.HexToHash("0x02"), 2, regent.CurrentHead, regent.SyncedHeight)
+	}
+	expected := []string{"engine_newPayloadV1", "engine_forkchoiceUpdatedV1", "engine_newPayloadV1", "engine_forkchoiceUpdatedV1", "engine_forkchoiceUpdatedV1"}
+	if fmt.Sprint(*methods) != fmt.Sprint(expected) {
+		t.Fatalf("sync - expected calls %v, got %v", expected, *methods)
+	}
+	if behind, _ := regent.isBehindDA(); behind {
+		t.Fatalf("isBehindDA - expected %v, got %v", false, behind)
+	}
+}
+
+func TestSync_replaysEachHeightInOneBatch(t *testing.T) {
+	methods := respondWithForkChoiceStatuses("VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	messages := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		messages++
+		test.TestHandler.ServeHTTP(resp, req)
+	}))
+	defer server.Close()
+	client := rpc.NewClient("8545")
+	client.SetEndpoint(server.URL)
+	regent := Regent{EngineRpc: client, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"), common.HexToHash("0x02"))}
+
+	if err := regent.sync(context.Background()); err != nil || regent.CurrentHead != common.HexToHash("0x02") {
+		t.Fatalf("sync - expected head %v, got %v. err %v", common.HexToHash("0x02"), regent.CurrentHead, err)
+	}
+	// One message per DA height, and one to check the head
+	if messages != 3 || len(*methods) != 5 {
+		t.Fatalf("sync - expected %v requests in %v messages, got %v in %v", 5, 3, *methods, messages)
+	}
+}
+
+func TestSync_waitsForSyncingExecutionClient(t *testing.T) {
+	previousInterval := SyncPollInterval
+	SyncPollInterval = time.Millisecond
+	methods := respondWithForkChoiceStatuses("SYNCING", "SYNCING", "SYNCING", "VALID")
+	defer func() {
+		test.TestHandler.SetHandlerFunc(nil)
+		SyncPollInterval = previousInterval
+	}()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"))}
+
+	err := regent.sync(context.Background())
+	if err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	// One update while replaying, then polls until the head is VALID
+	if len(*methods) != 5 || regent.CurrentHead != common.HexToHash("0x01") {
+		t.Fatalf("sync - expected to poll until VALID, got calls %v and head %v", *methods, regent.CurrentHead)
+	}
+}
+
+func TestSync_invalidBlock(t *testing.T) {
+	methods := respondWithForkChoiceStatuses("INVALID", "VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"))}
+
+	// Anyone can post to DA, so an invalid block is skipped rather than halting the chain
+	err := regent.sync(context.Background())
+	if err != nil || regent.SyncedHeight != 1 || regent.CurrentHead != (common.Hash{}) || len(regent.PendingFinality) != 0 {
+		t.Fatalf("sync - expected to skip the invalid block, got head %v at DA height %v. err %v", regent.CurrentHead, regent.SyncedHeight, err)
+	}
+	if len(*methods) != 3 {
+		t.Fatalf("sync - expected to replay the block and then check the head, got %v", *methods)
+	}
+}
+
+func TestSync_unvalidatedBlockTurnsOutInvalid(t *testing.T) {
+	previousInterval := SyncPollInterval
+	SyncPollInterval = time.Millisecond
+	defer func() { SyncPollInterval = previousInterval }()
+	// The execution client can't validate either block while replaying them. Once it has caught up, it finds the
+	// second one to be invalid, and then validates the first one
+	forkChoiceStatuses := []string{`"SYNCING", "latestValidHash": null`, `"SYNCING", "latestValidHash": null`, `"INVALID", "latestValidHash": "0x0000000000000000000000000000000000000000000000000000000000000001"`, `"VALID", "latestValidHash": null`}
+	heads := make([]common.Hash, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(test.TestHandler.LastMethod(), "engine_newPayload") {
+			resp.Write([]byte(`{"result": {"status": "SYNCING", "latestValidHash": null, "validationError": null}}`))
+			return
+		}
+		heads = append(heads, lastForkChoiceState().HeadHash)
+		status := forkChoiceStatuses[0]
+		forkChoiceStatuses = forkChoiceStatuses[1:]
+		resp.Write([]byte(fmt.Sprintf(`{"result": {"payloadStatus": {"status": %s, "validationError": null}, "payloadId": null}}`, status)))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	path := t.TempDir() + "/" + STATE_FILENAME
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"), common.HexToHash("0x02")), Store: NewStateStore(path)}
+
+	// The invalid block is skipped rather than halting the chain, and the head rolls back to its valid parent
+	if err := regent.sync(context.Background()); err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	expectedHeads := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x02"), common.HexToHash("0x01")}
+	if fmt.Sprint(heads) != fmt.Sprint(expectedHeads) {
+		t.Fatalf("sync - expected to update the head to %v, got %v", expectedHeads, heads)
+	}
+	if regent.CurrentHead != common.HexToHash("0x01") || regent.SafeBlock.Hash != common.HexToHash("0x01") || regent.FinalizedBlock.Hash != common.HexToHash("0x01") || len(regent.Unvalidated) != 0 {
+		t.Fatalf("sync - expected %v to be the head, safe and finalized, got %+v", common.HexToHash("0x01"), regent)
+	}
+	// Only the validated head was ever stored
+	if state, _ := regent.Store.Load(); state.Head.Hash != common.HexToHash("0x01") || state.SyncedHeight != 2 {
+		t.Fatalf("sync - expected to store head %v at DA height %v, got %+v", common.HexToHash("0x01"), 2, state)
+	}
+}
+
+func TestSync_unvalidatedBlockIsNotStored(t *testing.T) {
+	respondWithForkChoiceStatuses("SYNCING")
+	respondToNewPayload("SYNCING")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	path := t.TempDir() + "/" + STATE_FILENAME
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01")), Store: NewStateStore(path)}
+	regent.saveState()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	// The execution client never validates the block, so it never becomes the head
+	if err := regent.sync(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sync - expected %v, got %v", context.DeadlineExceeded, err)
+	}
+	regent.saveState()
+	if state, _ := regent.Store.Load(); state.Head.Hash != (common.Hash{}) || state.SyncedHeight != 0 || regent.CurrentHead != (common.Hash{}) {
+		t.Fatalf("sync - expected the unvalidated block not to be stored, got %+v", state)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected Recovery
+	}{
+		{rpc.ErrFrom(rpc.ERR_REQUEST_SEND_FAILED, errors.New("connection refused")), RECOVERY_RETRY},
+		{rpc.ERR_SERVER_ERROR, RECOVERY_RETRY},
+		{fmt.Errorf("unable to get the next execution payload: %w", rpc.ERR_UNKNOWN_PAYLOAD), RECOVERY_RESYNC},
+		{&ForkChoiceUpdateError{ERR_EXECUTION_CLIENT_SYNCING}, RECOVERY_RESYNC},
+		{&PayloadBuildError{ERR_INVALID_TIMESTAMP}, RECOVERY_RESYNC},
+		{rpc.ERR_UNSUPPORTED_FORK, RECOVERY_RESYNC},
+		{&ForkChoiceUpdateError{ERR_INVALID_PAYLOAD}, RECOVERY_FATAL},
+		{rpc.ERR_INVALID_PARAMS, RECOVERY_FATAL},
+		{rpc.ErrFrom(rpc.ERR_NO_COMPATIBLE_METHOD, errors.New("none of V1 through V3")), RECOVERY_FATAL},
+	}
+	for _, tt := range tests {
+		if recovery := classify(tt.err); recovery != tt.expected {
+			t.Errorf("classify(%v) - expected %v, got %v", tt.err, tt.expected, recovery)
+		}
+	}
+}
+
+func TestRun_returnsFatalError(t *testing.T) {
+	simulatePayloadEviction(0)
+	// The execution client rejects a block it built on a different head than Regent's, so they disagree about the chain
+	building := test.TestHandler.HandlerFunc()
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(test.TestHandler.LastMethod(), "engine_getPayload") {
+			building(resp, req)
+			return
+		}
+		payload, _ := json.Marshal(rpc.Response[*commands.ExecutionPayload]{
+			Result: &commands.ExecutionPayload{BlockHash: common.HexToHash("0x01"), ParentHash: common.HexToHash("0x0bad"), BlockNumber: 1},
+		})
+		resp.Write(payload)
+	})
+	respondToNewPayload("INVALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: newTestDA(t)}
+
+	if err := regent.run(context.Background()); !errors.Is(err, ERR_INVALID_PAYLOAD) {
+		t.Fatalf("run - expected %v, got %v", ERR_INVALID_PAYLOAD, err)
+	}
+}
+
+func TestRun_retriesTransientErrors(t *testing.T) {
+	defer func(previous time.Duration) { RetryInterval = previous }(RetryInterval)
+	RetryInterval = time.Millisecond
+	// A request may still be in flight when run returns. Closing the server waits for it, so it can't reach the next test
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{"jsonrpc": "2.0", "error": {"code": -32000, "message": "Server error"}}`))
+	}))
+	defer server.Close()
+	client := rpc.NewClient("8545")
+	client.SetEndpoint(server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	regent := Regent{EngineRpc: client, Slots: TestSlots, DA: newTestDA(t, common.HexToHash("0x01"))}
+
+	if err := regent.run(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("run - expected to keep retrying until %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestSync_invalidPayloadStatus(t *testing.T) {
+	methods := make([]string, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		methods = append(methods, test.TestHandler.LastMethod())
+		if strings.HasPrefix(test.TestHandler.LastMethod(), "engine_newPayload") {
+			resp.Write([]byte(`{"result": {"status": "INVALID", "latestValidHash": null, "validationError": "bad state root"}}`))
+			return
+		}
+		resp.Write([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	fileDA := newTestDA(t, common.HexToHash("0x01"))
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: fileDA}
+
+	batches, _ := fileDA.GetBatches(1)
+	var block DABlock
+	json.Unmarshal(batches[0], &block)
+	replayed, err := regent.replayBlocks(context.Background(), 1, []*DABlock{&block})
+	if err != nil {
+		t.Fatalf("replayBlocks - expected %v, got %v", nil, err)
+	}
+	err = regent.applyReplayedBlock(&replayed[0])
+	var invalid *InvalidPayloadError
+	if !errors.As(err, &invalid) || invalid.BlockHash != common.HexToHash("0x01") || invalid.ValidationError != "bad state root" || invalid.LatestValidHash != nil {
+		t.Fatalf("applyReplayedBlock - expected an %T for %v, got %v", invalid, common.HexToHash("0x01"), err)
+	}
+
+	// The block is skipped without moving the head to it
+	methods = methods[:0]
+	if err := regent.sync(context.Background()); err != nil || regent.SyncedHeight != 1 || regent.CurrentHead != (common.Hash{}) {
+		t.Fatalf("sync - expected to skip the invalid block, got head %v at DA height %v. err %v", regent.CurrentHead, regent.SyncedHeight, err)
+	}
+	// The fork choice update sent along with the block doesn't move the head either, and then the head is checked
+	if len(methods) != 3 || !strings.HasPrefix(methods[0], "engine_newPayload") || !strings.HasPrefix(methods[2], "engine_forkchoiceUpdated") {
+		t.Fatalf("sync - expected only the head to be checked after replaying the block, got %v", methods)
+	}
+}
+
+func TestStateStore_saveAndLoad(t *testing.T) {
+	store := NewStateStore(t.TempDir() + "/" + STATE_FILENAME)
+	state, err := store.Load()
+	if state != nil || err != nil {
+		t.Fatalf("Load - expected no state, got %v. err %v", state, err)
+	}
+	expected := &ConsensusState{
+		Head:             BlockRef{Hash: common.HexToHash("0x03"), Number: 3},
+		Safe:             BlockRef{Hash: common.HexToHash("0x02"), Number: 2},
+		Finalized:        BlockRef{Hash: common.HexToHash("0x01"), Number: 1},
+		LastPostedHeight: 7,
+		SyncedHeight:     6,
+		PendingFinality:  []PendingBlock{{Block: BlockRef{Hash: common.HexToHash("0x02"), Number: 2}, DAHeight: 6}},
+		LatestTimestamp:  1700000000,
+	}
+	if err := store.Save(expected); err != nil {
+		t.Fatalf("Save - expected %v, got %v", nil, err)
+	}
+	state, err = store.Load()
+	if err != nil || !reflect.DeepEqual(state, expected) {
+		t.Fatalf("Load - expected %+v, got %+v. err %v", expected, state, err)
+	}
+}
+
+func TestRestoreState_resumesAfterRestart(t *testing.T) {
+	response := `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
+	test.TestHandler.SetResponse([]byte(response))
+	path := t.TempDir() + "/" + STATE_FILENAME
+
+	genesisHash := common.HexToHash(utils.GENESIS_HASH_STRING)
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, GenesisHash: genesisHash, Store: NewStateStore(path)}
+	if err := regent.restoreState(); err != nil || regent.CurrentHead != common.HexToHash(utils.GENESIS_HASH_STRING) {
+		t.Fatalf("restoreState - expected to start from genesis, got %v. err %v", regent.CurrentHead, err)
+	}
+	regent.LastPostedHeight = 1
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash("0x01"), utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", nil, err)
+	}
+
+	restarted := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, GenesisHash: genesisHash, Store: NewStateStore(path)}
+	if err := restarted.restoreState(); err != nil {
+		t.Fatalf("restoreState - expected %v, got %v", nil, err)
+	}
+	if restarted.CurrentHead != common.HexToHash("0x01") || restarted.CurrentHeadNumber != 1 || restarted.LastPostedHeight != 1 {
+		t.Fatalf("restoreState - expected head %v at number %v, got %+v", common.HexToHash("0x01"), 1, restarted)
+	}
+	state, _ := restarted.Store.Load()
+	if state.Finalized.Hash != common.HexToHash(utils.GENESIS_HASH_STRING) || state.Finalized.Number != 0 {
+		t.Fatalf("restoreState - expected genesis to be finalized, got %+v", state.Finalized)
+	}
+}
+
+// Returns a clock with 1.5 second slots starting at genesis, and a function which sets the current time
+func testSlotClock(genesis uint64) (*SlotClock, func(time.Time)) {
+	clock := test.NewFakeClock(time.Unix(int64(genesis), 0))
+	return NewSlotClock(genesis, 1500*time.Millisecond, clock), clock.Set
+}
+
+func TestSlotClock_slots(t *testing.T) {
+	clock, setNow := testSlotClock(1000)
+	setNow(time.Unix(900, 0))
+	if slot := clock.CurrentSlot(); slot != 0 {
+		t.Fatalf("CurrentSlot - expected slot %v before genesis, got %v", 0, slot)
+	}
+	setNow(time.Unix(1004, 600*int64(time.Millisecond)))
+	if slot := clock.CurrentSlot(); slot != 3 {
+		t.Fatalf("CurrentSlot - expected %v, got %v", 3, slot)
+	}
+	// Slot 3 starts at 1004.5s, so its timestamp is rounded down
+	if start, timestamp := clock.SlotStart(3), clock.Timestamp(3); !start.Equal(time.Unix(1004, 500*int64(time.Millisecond))) || timestamp != 1004 {
+		t.Fatalf("SlotStart - expected slot %v to start at 1004.5s with timestamp %v, got %v and %v", 3, 1004, start, timestamp)
+	}
+}
+
+func TestSlotClock_nextSlotAfter(t *testing.T) {
+	clock, setNow := testSlotClock(1000)
+	setNow(time.Unix(1001, 0))
+	tests := []struct {
+		latest   uint64
+		expected uint64
+	}{
+		// The next slot to start is 1 at 1001.5s
+		{0, 1},
+		{1000, 1},
+		// Slot 1 would have the same timestamp as its parent, so the block is built for slot 2 at 1003s
+		{1001, 2},
+		// The parent is from the future, e.g. because the wall clock went backwards. Slot 7 at 1010.5s has the same
+		// timestamp, so the first later slot is 8 at 1012s
+		{1010, 8},
+	}
+	for _, tt := range tests {
+		slot := clock.NextSlotAfter(tt.latest)
+		if slot != tt.expected || clock.Timestamp(slot) <= tt.latest {
+			t.Errorf("NextSlotAfter(%v) - expected slot %v, got %v with timestamp %v", tt.latest, tt.expected, slot, clock.Timestamp(slot))
+		}
+	}
+}
+
+func TestSlotClock_waitForSlot(t *testing.T) {
+	fake := test.NewFakeClock(time.Unix(1001, 0))
+	clock := NewSlotClock(1000, 1500*time.Millisecond, fake)
+	if err := clock.WaitForSlot(context.Background(), 2); err != nil || !fake.Now().Equal(clock.SlotStart(2)) {
+		t.Fatalf("WaitForSlot - expected to wake up at %v, got %v. err %v", clock.SlotStart(2), fake.Now(), err)
+	}
+	// A slot which has started doesn't wait
+	if err := clock.WaitForSlot(context.Background(), 1); err != nil || len(fake.Sleeps()) != 1 {
+		t.Fatalf("WaitForSlot - expected not to wait, got %v. err %v", fake.Sleeps(), err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := clock.WaitForSlot(ctx, 10); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WaitForSlot - expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestExtendChainAndStartBuilder_slotTimestamps(t *testing.T) {
+	test.TestHandler.SetResponse([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`))
+	clock, setNow := testSlotClock(1000)
+	setNow(time.Unix(1001, 0))
+	regent := Regent{EngineRpc: TestRpcClient, Slots: clock}
+
+	// The builder is started once slot 1 starts at 1001.5s
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), common.Hash{}, utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v, got %v", nil, err)
+	}
+	if regent.NextSlot != 1 || regent.NextPayloadAttributes.Timestamp != 1001 || clock.CurrentSlot() != 1 {
+		t.Fatalf("ExtendChainAndStartBuilder - expected slot %v at %v, got slot %v at %v", 1, 1001, regent.NextSlot, regent.NextPayloadAttributes.Timestamp)
+	}
+	if deadline := clock.Deadline(regent.NextSlot, 500*time.Millisecond); !deadline.Equal(time.Unix(1002, 500*int64(time.Millisecond))) {
+		t.Fatalf("Deadline - expected %v, got %v", time.Unix(1002, 500*int64(time.Millisecond)), deadline)
+	}
+
+	// A block replayed from DA has the timestamp of slot 2, so the next block skips it
+	regent.observeTimestamp(1003)
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash("0x01"), utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v, got %v", nil, err)
+	}
+	if regent.NextSlot != 3 || regent.NextPayloadAttributes.Timestamp != 1004 {
+		t.Fatalf("ExtendChainAndStartBuilder - expected slot %v at %v, got slot %v at %v", 3, 1004, regent.NextSlot, regent.NextPayloadAttributes.Timestamp)
+	}
+}
+
+func TestExtendChainAndStartBuilder_updatesHeadBeforeSlot(t *testing.T) {
+	clock := test.NewFakeClock(time.Unix(1001, 0))
+	slots := NewSlotClock(1000, 1500*time.Millisecond, clock)
+	// The time of each fork choice update, and whether it had payload attributes
+	updates := make([]string, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request struct {
+			Params []json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(test.TestHandler.LastRequest(), &request)
+		updates = append(updates, fmt.Sprintf("%v/%v", clock.Now().UnixMilli(), len(request.Params)))
+		resp.Write([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	regent := Regent{EngineRpc: TestRpcClient, Slots: slots}
+
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), common.HexToHash("0x01"), utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v, got %v", nil, err)
+	}
+	// The head is updated at once, and the builder is started when slot 1 starts at 1001.5s
+	expected := []string{"1001000/1", "1001500/2"}
+	if fmt.Sprint(updates) != fmt.Sprint(expected) || regent.CurrentHead != common.HexToHash("0x01") {
+		t.Fatalf("ExtendChainAndStartBuilder - expected updates %v, got %v and head %v", expected, updates, regent.CurrentHead)
+	}
+}
+
+// Builds a chain in which every payload has the timestamp it was started with. Returns a pointer to the timestamps of
+// the payloads which were fetched. ctx is cancelled once the given number of payloads has been sent back
+func simulateBuilder(blocks int, cancel context.CancelFunc) *[]uint64 {
+	timestamps := make([]uint64, 0)
+	var building []uint64
+	sent := 0
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.Unmarshal(test.TestHandler.LastRequest(), &request)
+		switch {
+		case strings.HasPrefix(request.Method, "engine_forkchoiceUpdated") && len(request.Params) < 2:
+			resp.Write([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+		case strings.HasPrefix(request.Method, "engine_forkchoiceUpdated"):
+			var attributes struct {
+				Timestamp hexutil.Uint64 `json:"timestamp"`
+			}
+			json.Unmarshal(request.Params[1], &attributes)
+			building = append(building, uint64(attributes.Timestamp))
+			resp.Write([]byte(fmt.Sprintf(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x%016x"}}`, len(building))))
+		case strings.HasPrefix(request.Method, "engine_getPayload"):
+			timestamp := building[len(building)-1]
+			timestamps = append(timestamps, timestamp)
+			payload, _ := json.Marshal(rpc.Response[*commands.ExecutionPayload]{
+				Result: &commands.ExecutionPayload{BlockHash: common.HexToHash(fmt.Sprintf("0x%x", len(building))), Timestamp: hexutil.Uint64(timestamp)},
+			})
+			resp.Write(payload)
+		case strings.HasPrefix(request.Method, "engine_newPayload"):
+			if sent++; sent == blocks {
+				cancel()
+			}
+			resp.Write([]byte(`{"result": {"status": "VALID", "latestValidHash": null, "validationError": null}}`))
+		}
+	})
+	return &timestamps
+}
+
+func TestRun_producesBlockInEverySlot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	timestamps := simulateBuilder(20, cancel)
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	clock := test.NewFakeClock(time.Unix(1000, 0))
+	regent := Regent{
+		EngineRpc:     TestRpcClient,
+		Clock:         clock,
+		Slots:         NewSlotClock(1000, 2*time.Second, clock),
+		BuildDeadline: 500 * time.Millisecond,
+		DA:            newTestDA(t),
+	}
+
+	start := time.Now()
+	if err := regent.run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("run - expected %v, got %v", context.Canceled, err)
+	}
+	// Twenty slots of two seconds pass on the fake clock, without waiting for them
+	if len(*timestamps) != 20 || time.Since(start) > 5*time.Second {
+		t.Fatalf("run - expected %v payloads, got %v in %v", 20, len(*timestamps), time.Since(start))
+	}
+	for i, timestamp := range *timestamps {
+		if expected := uint64(1002 + 2*i); timestamp != expected {
+			t.Fatalf("run - expected payload %v to have timestamp %v, got %v", i, expected, timestamp)
+		}
+	}
+	// Every payload was fetched at the build deadline of its slot
+	for i, sleep := range clock.Sleeps() {
+		if sleep != 2*time.Second && sleep != 1500*time.Millisecond && sleep != 500*time.Millisecond {
+			t.Fatalf("run - expected to wait for slot starts and build deadlines, got wait %v of %v", i, clock.Sleeps())
+		}
+	}
+}
+
+func TestBuildMetrics_record(t *testing.T) {
+	metrics := BuildMetrics{Vars: new(expvar.Map).Init()}
+	if metrics.AverageTransactions() != 0 || metrics.GasPerSecond() != 0 {
+		t.Fatalf("BuildMetrics - expected no statistics, got %+v", metrics)
+	}
+	metrics.Record(3, 60_000, 30_000_000, time.Second)
+	metrics.Record(1, 21_000, 30_000_000, 500*time.Millisecond)
+	if metrics.Payloads != 2 || metrics.AverageTransactions() != 2 || metrics.GasPerSecond() != 54_000 {
+		t.Fatalf("BuildMetrics - expected %v payloads with %v txs and %v gas/s on average, got %+v", 2, 2, 54_000, metrics)
+	}
+	expected := map[string]string{"payloads": "2", "transactions": "4", "buildTimeMs": "1500", "lastTransactions": "1", "lastGasLimit": "30000000", "gasPerSecond": "54000"}
+	for key, value := range expected {
+		if v := metrics.Vars.Get(key); v == nil || v.String() != value {
+			t.Errorf("BuildMetrics - expected %v to be published as %v, got %v", key, value, v)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := serveMetrics(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("serveMetrics - expected %v, got %v", nil, err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%v/debug/vars", addr))
+	if err != nil {
+		t.Fatalf("serveMetrics - expected %v, got %v", nil, err)
+	}
+	defer resp.Body.Close()
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil || vars["regent_build"] == nil {
+		t.Fatalf("serveMetrics - expected the build metrics, got %v. err %v", vars, err)
+	}
+}
+
+// Decodes the fork choice state from the most recent request to the mock server
+func lastForkChoiceState() commands.ForkChoiceState {
+	var msg struct {
+		Params []json.RawMessage `json:"params"`
+	}
+	json.Unmarshal(test.TestHandler.LastRequest(), &msg)
+	state := commands.ForkChoiceState{}
+	if len(msg.Params) > 0 {
+		json.Unmarshal(msg.Params[0], &state)
+	}
+	return state
+}
+
+func TestSync_ownBlockIsMarkedSafeOnce(t *testing.T) {
+	respondWithForkChoiceStatuses("VALID")
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	// The block isn't final yet, so it stays pending
+	fileDA, _ := da.NewFileDA(t.TempDir(), 5)
+	payload := &rpc.ExecutionPayloadV3{}
+	payload.BlockHash = common.HexToHash("0x01")
+	batch, _ := json.Marshal(&DABlock{Payload: payload})
+	fileDA.PostBatch(batch)
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: fileDA}
+	// This node posted the block, but failed to make it the head, so syncing replays it
+	regent.markSafe(BlockRef{Hash: common.HexToHash("0x01")}, 1)
+
+	if err := regent.sync(context.Background()); err != nil {
+		t.Fatalf("sync - expected %v, got %v", nil, err)
+	}
+	if len(regent.PendingFinality) != 1 || regent.CurrentHead != common.HexToHash("0x01") {
+		t.Fatalf("sync - expected a single pending block, got %+v", regent.PendingFinality)
+	}
+}
+
+func TestExtendChainAndStartBuilder_tracksSafeAndFinalized(t *testing.T) {
+	response := `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`
+	test.TestHandler.SetResponse([]byte(response))
+	// Blocks are final once one more height has been built on top of them
+	fileDA, _ := da.NewFileDA(t.TempDir(), 1)
+	genesis := BlockRef{Hash: common.HexToHash(utils.GENESIS_HASH_STRING)}
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: fileDA, SafeBlock: genesis, FinalizedBlock: genesis, CurrentHead: genesis.Hash}
+
+	for i := uint64(1); i <= 3; i++ {
+		block := BlockRef{Hash: common.BigToHash(new(big.Int).SetUint64(i)), Number: i}
+		height, _ := fileDA.PostBatch([]byte{})
+		regent.markSafe(block, height)
+		if err := regent.ExtendChainAndStartBuilder(context.Background(), block.Hash, utils.DEV_ADDRESS); err != nil {
+			t.Fatalf("ExtendChainAndStartBuilder - expected: %v, got: %v", nil, err)
+		}
+
+		state := lastForkChoiceState()
+		expectedFinalized := genesis.Hash
+		if i > 1 {
+			expectedFinalized = common.BigToHash(new(big.Int).SetUint64(i - 1))
+		}
+		if state.HeadHash != block.Hash || state.SafeBlockHash != block.Hash || state.FinalizedBlockHash != expectedFinalized {
+			t.Fatalf("ExtendChainAndStartBuilder - expected head %v, safe %v, finalized %v, got %+v", block.Hash, block.Hash, expectedFinalized, state)
+		}
+	}
+	if len(regent.PendingFinality) != 1 || regent.FinalizedBlock.Number != 2 {
+		t.Fatalf("ExtendChainAndStartBuilder - expected block 2 to be finalized and block 3 pending, got %+v and %+v", regent.FinalizedBlock, regent.PendingFinality)
+	}
+}
+
+func TestExtendChainAndStartBuilder_commitsFinalityOnceApplied(t *testing.T) {
+	test.TestHandler.SetResponse([]byte(`{"result": {"payloadStatus": {"status": "SYNCING", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+	fileDA, _ := da.NewFileDA(t.TempDir(), 0)
+	genesis := BlockRef{Hash: common.HexToHash(utils.GENESIS_HASH_STRING)}
+	regent := Regent{EngineRpc: TestRpcClient, Slots: TestSlots, DA: fileDA, SafeBlock: genesis, FinalizedBlock: genesis, CurrentHead: genesis.Hash}
+	block := BlockRef{Hash: common.HexToHash("0x01"), Number: 1}
+	height, _ := fileDA.PostBatch([]byte{})
+	regent.markSafe(block, height)
+
+	// The block is proposed as finalized, but the execution client didn't apply the update
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), block.Hash, utils.DEV_ADDRESS); err == nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected an error, got %v", err)
+	}
+	if state := lastForkChoiceState(); state.FinalizedBlockHash != block.Hash {
+		t.Fatalf("ExtendChainAndStartBuilder - expected to propose %v as finalized, got %v", block.Hash, state.FinalizedBlockHash)
+	}
+	if regent.FinalizedBlock != genesis || len(regent.PendingFinality) != 1 {
+		t.Fatalf("ExtendChainAndStartBuilder - expected finality to be unchanged, got %+v and %+v", regent.FinalizedBlock, regent.PendingFinality)
+	}
+
+	test.TestHandler.SetResponse([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": "0x0000000000000001"}}`))
+	if err := regent.ExtendChainAndStartBuilder(context.Background(), block.Hash, utils.DEV_ADDRESS); err != nil {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v, got %v", nil, err)
+	}
+	if regent.FinalizedBlock != block || len(regent.PendingFinality) != 0 {
+		t.Fatalf("ExtendChainAndStartBuilder - expected %v to be finalized, got %+v and %+v", block, regent.FinalizedBlock, regent.PendingFinality)
+	}
+}
+
+// Returns a getenv function backed by the given map
+func envFrom(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestParseConfig_defaults(t *testing.T) {
+	config, err := ParseConfig([]string{"--data-dir", "/tmp/regent"}, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("ParseConfig - expected %v, got %v", nil, err)
+	}
+	if config.EngineUrl != "http://localhost:8551" || config.SlotTime != 5*time.Second || config.BuildDeadline != 500*time.Millisecond || config.LogLevel != log.LvlInfo {
+		t.Fatalf("ParseConfig - expected default values, got %+v", config)
+	}
+	if config.JwtSecretPath != "/tmp/regent/"+JWT_SECRET_FILENAME {
+		t.Fatalf("ParseConfig - expected jwt secret in data dir, got %v", config.JwtSecretPath)
+	}
+	// An IPC socket is protected by its file permissions rather than a JWT
+	config, err = ParseConfig([]string{"--data-dir", "/tmp/regent", "--engine-url", "ipc:///tmp/engine.ipc"}, envFrom(nil), io.Discard)
+	if err != nil || config.JwtSecretPath != "" {
+		t.Fatalf("ParseConfig - expected no jwt secret for an ipc endpoint, got %q. err %v", config.JwtSecretPath, err)
+	}
+	if config.GenesisHash != common.HexToHash(utils.GENESIS_HASH_STRING) || config.FeeRecipient != utils.DEV_ADDRESS {
+		t.Fatalf("ParseConfig - expected dev genesis and fee recipient, got %+v", config)
+	}
+	if config.ShanghaiTime != nil || config.CancunTime != nil {
+		t.Fatalf("ParseConfig - expected no forks, got %v and %v", config.ShanghaiTime, config.CancunTime)
+	}
+}
+
+func TestParseConfig_precedence(t *testing.T) {
+	path := t.TempDir() + "/regent.toml"
+	os.WriteFile(path, []byte("slot-time = \"2s\"\nlog-level = \"debug\"\nda-confirmations = 3\n"), 0644)
+	env := map[string]string{"REGENT_CONFIG": path, "REGENT_SLOT_TIME": "3s", "REGENT_LOG_LEVEL": "warn"}
+
+	config, err := ParseConfig([]string{"--log-level", "error"}, envFrom(env), io.Discard)
+	if err != nil {
+		t.Fatalf("ParseConfig - expected %v, got %v", nil, err)
+	}
+	if config.DAConfirmations != 3 {
+		t.Fatalf("ParseConfig - expected da-confirmations from file %v, got %v", 3, config.DAConfirmations)
+	}
+	if config.SlotTime != 3*time.Second {
+		t.Fatalf("ParseConfig - expected slot-time from env %v, got %v", 3*time.Second, config.SlotTime)
+	}
+	if config.LogLevel != log.LvlError {
+		t.Fatalf("ParseConfig - expected log-level from flag %v, got %v", log.LvlError, config.LogLevel)
+	}
+}
+
+func TestParseConfig_yaml(t *testing.T) {
+	path := t.TempDir() + "/regent.yaml"
+	os.WriteFile(path, []byte("engine-url: https://engine.example:8551\nshanghai-time: 100\ncancun-time: 200\n"), 0644)
+
+	config, err := ParseConfig([]string{"--config", path}, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("ParseConfig - expected %v, got %v", nil, err)
+	}
+	if config.EngineUrl != "https://engine.example:8551" || *config.ShanghaiTime != 100 || *config.CancunTime != 200 {
+		t.Fatalf("ParseConfig - expected values from file, got %+v", config)
+	}
+}
+
+func TestParseConfig_policies(t *testing.T) {
+	config, err := ParseConfig([]string{"--data-dir", "/tmp/regent"}, envFrom(nil), io.Discard)
+	if err != nil || len(config.Policies) != 0 {
+		t.Fatalf("ParseConfig - expected no policy overrides by default, got %v. err %v", config.Policies, err)
+	}
+
+	path := t.TempDir() + "/regent.toml"
+	os.WriteFile(path, []byte("get-payload-timeout = \"500ms\"\nnew-payload-max-attempts = 10\n"), 0644)
+	config, err = ParseConfig([]string{"--config", path, "--new-payload-max-retry-time", "1m"}, envFrom(nil), io.Discard)
+	if err != nil {
+		t.Fatalf("ParseConfig - expected %v, got %v", nil, err)
+	}
+	if policy := config.Policies[rpc.GET_EXECUTION_PAYLOAD_V3]; policy.Timeout != 500*time.Millisecond {
+		t.Fatalf("ParseConfig - expected a getPayload timeout of %v, got %+v", 500*time.Millisecond, policy)
+	}
+	policy := config.Policies[rpc.NEW_EXECUTION_PAYLOAD]
+	if policy.Timeout != rpc.DefaultPolicies[rpc.NEW_EXECUTION_PAYLOAD].Timeout || policy.Backoff.MaxAttempts != 10 || policy.Backoff.MaxElapsedTime != time.Minute {
+		t.Fatalf("ParseConfig - expected newPayload to keep its timeout and use the configured retries, got %+v %+v", policy, policy.Backoff)
+	}
+	if _, ok := config.Policies[rpc.FORK_CHOICE_UPDATED]; ok {
+		t.Fatalf("ParseConfig - expected no override for %v", rpc.FORK_CHOICE_UPDATED)
+	}
+	if rpc.NEW_PAYLOAD_POLICY.Backoff.MaxAttempts != 0 {
+		t.Fatalf("ParseConfig - expected the default backoff to be left unchanged, got %+v", rpc.NEW_PAYLOAD_POLICY.Backoff)
+	}
+}
+
+func TestParseConfig_invalid(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected error
+	}{
+		{[]string{"--engine-url", "localhost:8551"}, ERR_INVALID_CONFIG},
+		{[]string{"--engine-ca-cert", "ca.pem"}, ERR_INVALID_CONFIG},
+		{[]string{"--engine-url", "ipc:///tmp/engine.ipc", "--jwt-secret", "jwt.hex"}, ERR_INVALID_CONFIG},
+		{[]string{"--engine-url", "https://engine.example", "--engine-client-cert", "client.crt"}, ERR_INVALID_CONFIG},
+		{[]string{"--genesis-hash", "0x1234"}, ERR_INVALID_CONFIG},
+		{[]string{"--fee-recipient", "nobody"}, ERR_INVALID_CONFIG},
+		{[]string{"--slot-time", "100ms"}, ERR_INVALID_CONFIG},
+		{[]string{"--genesis-time", "-1"}, ERR_INVALID_CONFIG},
+		{[]string{"--slot-time", "2s", "--build-deadline", "2s"}, ERR_INVALID_CONFIG},
+		{[]string{"--log-level", "loud"}, ERR_INVALID_CONFIG},
+		{[]string{"--da-confirmations", "-1"}, ERR_INVALID_CONFIG},
+		{[]string{"--cancun-time", "10"}, ERR_INVALID_CONFIG},
+		{[]string{"--shanghai-time", "20", "--cancun-time", "10"}, ERR_INVALID_CONFIG},
+		{[]string{"--get-payload-timeout", "0s"}, ERR_INVALID_CONFIG},
+		{[]string{"--new-payload-max-attempts", "many"}, ERR_INVALID_CONFIG},
+		{[]string{"--fork-choice-max-retry-time", "-1s"}, ERR_INVALID_CONFIG},
+		{[]string{"--metrics-addr", "6060"}, ERR_INVALID_CONFIG},
+		{[]string{"--config", "regent.json"}, ERR_UNSUPPORTED_EXT},
+	}
+	for _, tt := range tests {
+		_, err := ParseConfig(tt.args, envFrom(nil), io.Discard)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("ParseConfig(%v) - expected %v, got %v", tt.args, tt.expected, err)
+		}
+	}
+
+	path := t.TempDir() + "/regent.toml"
+	os.WriteFile(path, []byte("slot_time = \"2s\"\n"), 0644)
+	if _, err := ParseConfig([]string{"--config", path}, envFrom(nil), io.Discard); !errors.Is(err, ERR_UNKNOWN_OPTION) {
+		t.Fatalf("ParseConfig - expected %v, got %v", ERR_UNKNOWN_OPTION, err)
+	}
+}
+
+func TestParseConfig_help(t *testing.T) {
+	var output strings.Builder
+	_, err := ParseConfig([]string{"--help"}, envFrom(nil), &output)
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("ParseConfig - expected %v, got %v", flag.ErrHelp, err)
+	}
+	for _, opt := range options {
+		if !strings.Contains(output.String(), "--"+opt.name) || !strings.Contains(output.String(), envName(opt.name)) {
+			t.Errorf("ParseConfig - expected usage to document %v, got %v", opt.name, output.String())
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"regent/rpc"
+	"regent/utils"
+	"time"
+)
+
+// Divides time into slots of equal length, starting at genesis. Slot n starts at genesis + n * slotTime, and the
+// block built for slot n has the start of the slot, in seconds, as its timestamp. Deriving timestamps from the slot
+// rather than the wall clock keeps block times from drifting
+type SlotClock struct {
+	genesis  time.Time
+	slotTime time.Duration
+	clock    utils.Clock
+}
+
+func NewSlotClock(genesisTime uint64, slotTime time.Duration, clock utils.Clock) *SlotClock {
+	return &SlotClock{
+		genesis:  time.Unix(int64(genesisTime), 0),
+		slotTime: slotTime,
+		clock:    clock,
+	}
+}
+
+func (c *SlotClock) SlotTime() time.Duration {
+	return c.slotTime
+}
+
+// The slot in progress at the given time. Times before genesis are in slot 0
+func (c *SlotClock) SlotAt(t time.Time) uint64 {
+	if t.Before(c.genesis) {
+		return 0
+	}
+	return uint64(t.Sub(c.genesis) / c.slotTime)
+}
+
+func (c *SlotClock) CurrentSlot() uint64 {
+	return c.SlotAt(c.clock.Now())
+}
+
+func (c *SlotClock) SlotStart(slot uint64) time.Time {
+	return c.genesis.Add(time.Duration(slot) * c.slotTime)
+}
+
+// The timestamp of the block built for the given slot
+func (c *SlotClock) Timestamp(slot uint64) uint64 {
+	return uint64(c.SlotStart(slot).Unix())
+}
+
+// The first slot which has yet to start and whose timestamp is later than the given one. A block must be later than
+// its parent, which can matter when the slot time isn't a whole number of seconds or the wall clock went backwards
+func (c *SlotClock) NextSlotAfter(timestamp uint64) uint64 {
+	next := c.CurrentSlot() + 1
+	// The first slot which starts at or after timestamp + 1 second, which is the first with a later timestamp
+	later := time.Unix(int64(timestamp)+1, 0)
+	if later.After(c.genesis) {
+		slot := uint64((later.Sub(c.genesis) + c.slotTime - 1) / c.slotTime)
+		if slot > next {
+			next = slot
+		}
+	}
+	return next
+}
+
+// The time at which the payload built for the given slot is fetched, which leaves margin before the next slot starts
+func (c *SlotClock) Deadline(slot uint64, margin time.Duration) time.Time {
+	return c.SlotStart(slot + 1).Add(-margin)
+}
+
+// Waits until the given slot starts, unless ctx is cancelled first
+func (c *SlotClock) WaitForSlot(ctx context.Context, slot uint64) error {
+	return c.WaitUntil(ctx, c.SlotStart(slot))
+}
+
+// Waits until the given time, unless ctx is cancelled first
+func (c *SlotClock) WaitUntil(ctx context.Context, t time.Time) error {
+	wait := t.Sub(c.clock.Now())
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	return rpc.Sleep(ctx, c.clock, wait)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regent/utils"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const STATE_FILENAME = "regent_state.json"
+
+// A block hash and number
+type BlockRef struct {
+	Hash   common.Hash `json:"hash"`
+	Number uint64      `json:"number"`
+}
+
+// The consensus state which must survive a restart
+type ConsensusState struct {
+	Head      BlockRef `json:"head"`
+	Safe      BlockRef `json:"safe"`
+	Finalized BlockRef `json:"finalized"`
+	// The DA height of the most recent block posted by this node
+	LastPostedHeight uint64 `json:"lastPostedHeight"`
+	// The DA height up to which all blocks have been applied to the execution client
+	SyncedHeight uint64 `json:"syncedHeight"`
+	// Blocks which are safe but not yet finalized
+	PendingFinality []PendingBlock `json:"pendingFinality"`
+	// The timestamp of the latest block built or replayed
+	LatestTimestamp uint64 `json:"latestTimestamp"`
+}
+
+// A block which has been included in the DA layer but is not yet final
+type PendingBlock struct {
+	Block    BlockRef `json:"block"`
+	DAHeight uint64   `json:"daHeight"`
+}
+
+// Stores the consensus state in a single JSON file
+type StateStore struct {
+	path string
+}
+
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+// Loads the stored state. Returns nil if no state has been saved yet
+func (s *StateStore) Load() (*ConsensusState, error) {
+	contents, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read the consensus state from %v: %w", s.path, err)
+	}
+	state := &ConsensusState{}
+	if err := json.Unmarshal(contents, state); err != nil {
+		return nil, fmt.Errorf("could not decode the consensus state in %v: %w", s.path, err)
+	}
+	return state, nil
+}
+
+// Saves the state. The state is written to a temporary file and then renamed,
+// so a crash leaves either the old or the new state on disk, never a mix of both.
+// The new state is only durable once the rename has been synced as well
+func (s *StateStore) Save(state *ConsensusState) error {
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(s.path))
+}
+
+// Resumes from the stored consensus state, or from genesis if there is none
+func (r *Regent) restoreState() error {
+	state, err := r.Store.Load()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		log.Info("No consensus state found. Starting from genesis")
+		genesis := BlockRef{Hash: r.GenesisHash, Number: 0}
+		r.SetCurrentHead(genesis.Hash)
+		r.CurrentHeadNumber = genesis.Number
+		r.SafeBlock = genesis
+		r.FinalizedBlock = genesis
+		return nil
+	}
+	log.Info("Resuming from stored consensus state", "head", state.Head.Hash, "number", state.Head.Number, "daHeight", state.SyncedHeight)
+	r.SetCurrentHead(state.Head.Hash)
+	r.CurrentHeadNumber = state.Head.Number
+	r.SafeBlock = state.Safe
+	r.FinalizedBlock = state.Finalized
+	r.PendingFinality = state.PendingFinality
+	r.LastPostedHeight = state.LastPostedHeight
+	r.SyncedHeight = state.SyncedHeight
+	r.LatestTimestamp = state.LatestTimestamp
+	return nil
+}
+
+// Persists the state after a successful fork choice update. Failing to save is not fatal, since
+// the DA layer is the source of truth: after a restart Regent re-syncs from the last saved height.
+func (r *Regent) saveState() {
+	if r.Store == nil {
+		return
+	}
+	// Blocks which haven't been validated aren't stored, so they are replayed again after a restart
+	syncedHeight := r.SyncedHeight
+	if len(r.Unvalidated) > 0 {
+		syncedHeight = r.Unvalidated[0].DAHeight - 1
+	}
+	err := r.Store.Save(&ConsensusState{
+		Head:             BlockRef{Hash: r.CurrentHead, Number: r.CurrentHeadNumber},
+		Safe:             r.SafeBlock,
+		Finalized:        r.FinalizedBlock,
+		LastPostedHeight: r.LastPostedHeight,
+		SyncedHeight:     syncedHeight,
+		PendingFinality:  r.PendingFinality,
+		LatestTimestamp:  r.LatestTimestamp,
+	})
+	if err != nil {
+		log.Error("Unable to save the consensus state", "err", err)
+	}
+}
+
+// Records that a block was included in the DA layer at the given height, which makes it safe. A block can be marked
+// twice, e.g. when this node posts it but fails to make it the head, and then replays it while syncing
+func (r *Regent) markSafe(block BlockRef, daHeight uint64) {
+	r.SafeBlock = block
+	for _, pending := range r.PendingFinality {
+		if pending.Block == block && pending.DAHeight == daHeight {
+			return
+		}
+	}
+	r.PendingFinality = append(r.PendingFinality, PendingBlock{Block: block, DAHeight: daHeight})
+}
+
+// The latest safe block whose DA height has been finalized, or the current finalized block if there is none.
+// The state isn't changed until the execution client has applied the block as finalized, see commitFinalized
+func (r *Regent) nextFinalized() (BlockRef, error) {
+	if r.DA == nil || len(r.PendingFinality) == 0 {
+		return r.FinalizedBlock, nil
+	}
+	finalizedHeight, err := r.DA.FinalizedHeight()
+	if err != nil {
+		return r.FinalizedBlock, err
+	}
+	finalized := r.FinalizedBlock
+	for _, pending := range r.PendingFinality {
+		if pending.DAHeight > finalizedHeight {
+			break
+		}
+		finalized = pending.Block
+	}
+	return finalized, nil
+}
+
+// Records that the execution client applied a fork choice state with the given finalized block. The block and
+// every block before it no longer wait for finality
+func (r *Regent) commitFinalized(finalized common.Hash) {
+	for i, pending := range r.PendingFinality {
+		if pending.Block.Hash == finalized {
+			r.FinalizedBlock = pending.Block
+			r.PendingFinality = r.PendingFinality[i+1:]
+			return
+		}
+	}
+}
+
+// Returns the fork choice state with the given head, the current safe block and the next finalized block
+func (r *Regent) nextForkChoiceState(newHead common.Hash) commands.ForkChoiceState {
+	// If the DA layer can't be reached, the previous finalized block is still final
+	finalized, err := r.nextFinalized()
+	if err != nil {
+		log.Warn("Unable to fetch the finalized height from the DA layer", "err", err)
+	}
+	return commands.ForkChoiceState{
+		HeadHash:           newHead,
+		SafeBlockHash:      r.SafeBlock.Hash,
+		FinalizedBlockHash: finalized.Hash,
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regent/rpc"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Whether Regent is catching up with the DA layer or producing blocks
+type Mode int
+
+const (
+	MODE_SYNCING Mode = iota
+	MODE_PRODUCING
+)
+
+func (m Mode) String() string {
+	switch m {
+	case MODE_SYNCING:
+		return "syncing"
+	case MODE_PRODUCING:
+		return "producing"
+	default:
+		return fmt.Sprintf("unknown mode %d", m)
+	}
+}
+
+// How long to wait before asking a syncing execution client for the status of the head again
+var SyncPollInterval = time.Second
+
+// Indicates whether the DA layer contains blocks which have not been applied to the execution client
+func (r *Regent) isBehindDA() (bool, error) {
+	latest, err := r.DA.LatestHeight()
+	if err != nil {
+		return false, err
+	}
+	return latest > r.SyncedHeight, nil
+}
+
+// Replays every block from the DA layer which has not yet been applied into the execution client,
+// and then waits until the execution client reports the DA tip as VALID
+func (r *Regent) sync(ctx context.Context) error {
+	latest, err := r.DA.LatestHeight()
+	if err != nil {
+		return fmt.Errorf("could not fetch the latest DA height: %w", err)
+	}
+	if latest > r.SyncedHeight {
+		log.Info("Syncing from the DA layer", "from", r.SyncedHeight+1, "to", latest)
+	}
+
+	for height := r.SyncedHeight + 1; height <= latest; height++ {
+		batches, err := r.DA.GetBatches(height)
+		if err != nil {
+			return fmt.Errorf("could not fetch the batches at DA height %d: %w", height, err)
+		}
+		blocks := make([]*DABlock, 0, len(batches))
+		for _, batch := range batches {
+			var block DABlock
+			if err := json.Unmarshal(batch, &block); err != nil || block.Payload == nil {
+				// Anyone can post to DA, so batches which aren't blocks are skipped rather than halting the chain
+				log.Warn("Skipping a batch which does not contain a block", "height", height, "err", err)
+				continue
+			}
+			blocks = append(blocks, &block)
+		}
+		replayed, err := r.replayBlocks(ctx, height, blocks)
+		if err != nil {
+			return fmt.Errorf("could not replay the blocks at DA height %d: %w", height, err)
+		}
+		for i := range replayed {
+			block := &replayed[i]
+			err := r.applyReplayedBlock(block)
+			if errors.Is(err, ERR_INVALID_BLOCK_HASH) {
+				// Nobody can apply a block whose hash doesn't match its contents, so it is skipped like any other junk
+				log.Warn("Skipping a block with an invalid hash", "height", height, "blockhash", block.Payload.BlockHash)
+				continue
+			}
+			if errors.Is(err, ERR_INVALID_PAYLOAD) {
+				// Likewise for a block which the execution client found to be invalid. The head stays on its parent
+				log.Warn("Skipping an invalid block", "height", height, "blockhash", block.Payload.BlockHash, "err", err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		r.SyncedHeight = height
+	}
+
+	return r.waitForValidHead(ctx)
+}
+
+// Whether the execution client has yet to decide whether a block is valid. It should be asked again later
+func isPendingValidation(err error) bool {
+	return errors.Is(err, ERR_EXECUTION_CLIENT_SYNCING) || errors.Is(err, ERR_PAYLOAD_ACCEPTED)
+}
+
+// A block from DA, along with the requests which replayed it and their outcomes
+type replayedBlock struct {
+	*DABlock
+	daHeight uint64
+	// Sends the block to the execution client
+	payload rpc.BatchElem
+	// Makes the block the head, with the safe and finalized blocks in state
+	forkChoice rpc.BatchElem
+	state      *commands.ForkChoiceState
+}
+
+// Sends blocks from DA to the execution client in a single batch. Each block is followed by the fork choice update
+// which makes it the head, so a DA height costs a single round trip. Execution clients answer a batch in order, and
+// otherwise the update would only come back SYNCING and be retried by waitForValidHead
+func (r *Regent) replayBlocks(ctx context.Context, daHeight uint64, blocks []*DABlock) ([]replayedBlock, error) {
+	if len(blocks) == 0 {
+		return nil, nil
+	}
+	replayed := make([]replayedBlock, len(blocks))
+	batch := make([]rpc.BatchElem, 0, 2*len(blocks))
+	for i, block := range blocks {
+		payload, err := r.EngineRpc.ExecutionPayloadRequest(block.Payload, block.VersionedHashes, block.ParentBeaconBlockRoot)
+		if err != nil {
+			return nil, fmt.Errorf("could not send block %v to the execution client: %w", block.Payload.BlockHash, err)
+		}
+		state := r.nextForkChoiceState(block.Payload.BlockHash)
+		forkChoice, err := r.EngineRpc.ForkChoiceRequest(&state)
+		if err != nil {
+			return nil, &ForkChoiceUpdateError{err}
+		}
+		replayed[i] = replayedBlock{DABlock: block, daHeight: daHeight, state: &state}
+		batch = append(batch,
+			rpc.BatchElem{Request: payload, Result: &rpc.PayloadStatus{}},
+			rpc.BatchElem{Request: forkChoice, Result: &rpc.ForkChoiceUpdatedResult{}},
+		)
+	}
+	if err := r.EngineRpc.SendBatch(ctx, batch); err != nil {
+		return nil, err
+	}
+	for i := range replayed {
+		replayed[i].payload, replayed[i].forkChoice = batch[2*i], batch[2*i+1]
+	}
+	return replayed, nil
+}
+
+// Checks the execution client's verdict on a replayed block. A block which the execution client validated becomes
+// the head and is marked safe, along with the blocks it builds on, while a block whose validation is pending waits in
+// Unvalidated until it has been validated
+func (r *Regent) applyReplayedBlock(block *replayedBlock) error {
+	if block.payload.Error != nil {
+		return fmt.Errorf("could not send block %v to the execution client: %w", block.Payload.BlockHash, block.payload.Error)
+	}
+	// A syncing execution client can't validate the block yet, and an ACCEPTED block is only validated once it is
+	// part of the canonical chain. The fork choice update tells us when it has been validated
+	status := block.payload.Result.(*rpc.PayloadStatus)
+	if err := validatePayloadStatus(block.Payload.BlockHash, status); err != nil && !isPendingValidation(err) {
+		return err
+	}
+	r.observeTimestamp(uint64(block.Payload.Timestamp))
+
+	result := block.forkChoice.Result.(*rpc.ForkChoiceUpdatedResult)
+	err := validateForkChoiceUpdate(block.forkChoice.Error, result, block.state)
+	pending := PendingBlock{Block: BlockRef{Hash: block.Payload.BlockHash, Number: uint64(block.Payload.BlockNumber)}, DAHeight: block.daHeight}
+	switch {
+	case err == nil:
+		r.Unvalidated = append(r.Unvalidated, pending)
+		r.commitFinalized(block.state.FinalizedBlockHash)
+		r.resolveUnvalidated(len(r.Unvalidated))
+		return nil
+	case isPendingValidation(err):
+		// A syncing execution client will validate the block once it has caught up, so we can keep replaying
+		r.Unvalidated = append(r.Unvalidated, pending)
+		return nil
+	case errors.Is(err, ERR_INVALID_PAYLOAD):
+		// Either the block or one of the unvalidated blocks it builds on is invalid
+		r.rollBack(result.PayloadStatus.LatestValidHash)
+	}
+	return &ForkChoiceUpdateError{err}
+}
+
+// Resolves the replayed blocks which were waiting for validation: the first `valid` of them have been validated, and
+// the rest turned out to be invalid and are dropped. The latest valid block becomes the head, and the valid blocks
+// are marked safe. Only then is the state persisted, so the stored head is always one the execution client validated
+func (r *Regent) resolveUnvalidated(valid int) {
+	for _, pending := range r.Unvalidated[:valid] {
+		r.markSafe(pending.Block, pending.DAHeight)
+		r.SetCurrentHead(pending.Block.Hash)
+		r.CurrentHeadNumber = pending.Block.Number
+	}
+	r.Unvalidated = nil
+	r.saveState()
+}
+
+// Rolls the head back to the latest valid block after the execution client found a replayed block to be invalid.
+// The unvalidated blocks up to the latest valid hash are kept, and the others dropped. If the execution client doesn't
+// know the latest valid hash, the head stays at the latest block it validated
+func (r *Regent) rollBack(latestValidHash *common.Hash) {
+	valid := 0
+	if latestValidHash != nil {
+		for i, pending := range r.Unvalidated {
+			if pending.Block.Hash == *latestValidHash {
+				valid = i + 1
+			}
+		}
+	}
+	if dropped := len(r.Unvalidated) - valid; dropped > 0 {
+		log.Warn("Dropping replayed blocks which turned out to be invalid", "dropped", dropped, "latestValidHash", latestValidHash)
+	}
+	r.resolveUnvalidated(valid)
+}
+
+// Sends a fork choice update without payload attributes and records the new head if it was applied
+func (r *Regent) updateHead(ctx context.Context, newHead common.Hash, newHeadNumber uint64) error {
+	nextState := r.nextForkChoiceState(newHead)
+	result, err := r.EngineRpc.UpdateForkChoice(ctx, &nextState)
+	if forkChoiceErr := validateForkChoiceUpdate(err, result, &nextState); forkChoiceErr != nil {
+		return &ForkChoiceUpdateError{forkChoiceErr}
+	}
+	r.SetCurrentHead(newHead)
+	r.CurrentHeadNumber = newHeadNumber
+	r.commitFinalized(nextState.FinalizedBlockHash)
+	r.saveState()
+	return nil
+}
+
+// Polls the execution client until it reports the head as VALID. The execution client replies SYNCING while it is
+// still fetching or validating the chain. The head is the latest replayed block if there are unvalidated ones, which
+// are skipped like any other invalid block if the execution client finds them to be invalid
+func (r *Regent) waitForValidHead(ctx context.Context) error {
+	for {
+		head := r.CurrentHead
+		if len(r.Unvalidated) > 0 {
+			head = r.Unvalidated[len(r.Unvalidated)-1].Block.Hash
+		}
+		state := r.nextForkChoiceState(head)
+		result, err := r.EngineRpc.UpdateForkChoice(ctx, &state)
+		err = validateForkChoiceUpdate(err, result, &state)
+		switch {
+		case err == nil:
+			r.commitFinalized(state.FinalizedBlockHash)
+			r.resolveUnvalidated(len(r.Unvalidated))
+			return nil
+		case errors.Is(err, ERR_INVALID_PAYLOAD) && len(r.Unvalidated) > 0:
+			// The head is then checked again after rolling back
+			r.rollBack(result.PayloadStatus.LatestValidHash)
+			continue
+		case !isPendingValidation(err):
+			return &ForkChoiceUpdateError{err}
+		}
+		log.Info("Waiting for the execution client to sync", "head", head)
+		if err := rpc.Sleep(ctx, r.clock(), SyncPollInterval); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// The limits of an ExponentialBackoffStrategy. A zero MaxAttempts or MaxElapsedTime means no limit
+type BackoffConfig struct {
+	// The upper bound of the first wait
+	InitialInterval time.Duration
+	// The factor by which the upper bound grows after each attempt
+	Multiplier float64
+	// The largest upper bound of a single wait
+	MaxInterval time.Duration
+	// The number of attempts, including the first, after which the strategy gives up
+	MaxAttempts int
+	// The time since the strategy was created after which it gives up
+	MaxElapsedTime time.Duration
+}
+
+var DEFAULT_BACKOFF = BackoffConfig{
+	InitialInterval: 250 * time.Millisecond,
+	Multiplier:      2,
+	MaxInterval:     4 * time.Second,
+	MaxAttempts:     6,
+	MaxElapsedTime:  30 * time.Second,
+}
+
+// Retries with exponential backoff and "full jitter": the wait after the n-th failed attempt is drawn uniformly
+// from [0, min(MaxInterval, InitialInterval * Multiplier^(n-1))). Spreading retries out avoids clients hammering a
+// recovering execution client in lockstep. See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type ExponentialBackoffStrategy struct {
+	config BackoffConfig
+	// The number of waits handed out so far
+	retries int
+	start   time.Time
+	// Overridden in tests to make the schedule deterministic
+	now    func() time.Time
+	jitter func() float64
+}
+
+func NewExponentialBackoffStrategy(config BackoffConfig) *ExponentialBackoffStrategy {
+	return &ExponentialBackoffStrategy{
+		config: config,
+		start:  time.Now(),
+		now:    time.Now,
+		jitter: rand.Float64,
+	}
+}
+
+// The upper bound of the next wait
+func (s *ExponentialBackoffStrategy) ceiling() time.Duration {
+	ceiling := float64(s.config.InitialInterval) * math.Pow(s.config.Multiplier, float64(s.retries))
+	if ceiling > float64(s.config.MaxInterval) {
+		return s.config.MaxInterval
+	}
+	return time.Duration(ceiling)
+}
+
+func (s *ExponentialBackoffStrategy) Next() time.Duration {
+	wait := time.Duration(s.jitter() * float64(s.ceiling()))
+	s.retries++
+	// Never sleep past the deadline, since there would be no attempt afterwards
+	if s.config.MaxElapsedTime > 0 {
+		if remaining := s.config.MaxElapsedTime - s.now().Sub(s.start); wait > remaining {
+			wait = remaining
+		}
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+func (s *ExponentialBackoffStrategy) Done() bool {
+	if s.config.MaxAttempts > 0 && s.retries+1 >= s.config.MaxAttempts {
+		return true
+	}
+	return s.config.MaxElapsedTime > 0 && s.now().Sub(s.start) >= s.config.MaxElapsedTime
+}
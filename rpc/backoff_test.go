@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+)
+
+// Returns a strategy whose waits are the given fraction of their upper bound, and a function which advances its clock
+func deterministicBackoff(config BackoffConfig, fraction float64) (*ExponentialBackoffStrategy, func(time.Duration)) {
+	s := NewExponentialBackoffStrategy(config)
+	now := s.start
+	s.now = func() time.Time { return now }
+	s.jitter = func() float64 { return fraction }
+	return s, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestExponentialBackoffStrategy_schedule(t *testing.T) {
+	config := BackoffConfig{InitialInterval: 100 * time.Millisecond, Multiplier: 2, MaxInterval: time.Second}
+	expected := []time.Duration{100, 200, 400, 800, 1000, 1000}
+	for _, fraction := range []float64{1, 0.5} {
+		s, _ := deterministicBackoff(config, fraction)
+		for i, ceiling := range expected {
+			want := time.Duration(fraction * float64(ceiling*time.Millisecond))
+			if s.Done() {
+				t.Fatalf("Done - expected %v, got %v", false, true)
+			}
+			if got := s.Next(); got != want {
+				t.Fatalf("Next - expected wait %d to be %v, got %v", i, want, got)
+			}
+		}
+	}
+}
+
+func TestExponentialBackoffStrategy_fullJitter(t *testing.T) {
+	s := NewExponentialBackoffStrategy(BackoffConfig{InitialInterval: time.Second, Multiplier: 1, MaxInterval: time.Second})
+	distinct := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		wait := s.Next()
+		if wait < 0 || wait >= time.Second {
+			t.Fatalf("Next - expected a wait in [0, %v), got %v", time.Second, wait)
+		}
+		distinct[wait] = true
+	}
+	if len(distinct) < 50 {
+		t.Fatalf("Next - expected randomized waits, got %v distinct values out of 100", len(distinct))
+	}
+}
+
+func TestExponentialBackoffStrategy_maxAttempts(t *testing.T) {
+	s, _ := deterministicBackoff(BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 2, MaxInterval: time.Second, MaxAttempts: 4}, 1)
+	attempts := 1
+	for !s.Done() {
+		s.Next()
+		attempts++
+	}
+	if attempts != 4 {
+		t.Fatalf("Done - expected %v attempts, got %v", 4, attempts)
+	}
+}
+
+func TestExponentialBackoffStrategy_maxElapsedTime(t *testing.T) {
+	s, advance := deterministicBackoff(BackoffConfig{InitialInterval: time.Second, Multiplier: 2, MaxInterval: 10 * time.Second, MaxElapsedTime: 5 * time.Second}, 1)
+	advance(2 * time.Second)
+	if wait := s.Next(); wait != time.Second {
+		t.Fatalf("Next - expected %v, got %v", time.Second, wait)
+	}
+	advance(2 * time.Second)
+	// The second wait would be 2s, but only 1s remains
+	if wait := s.Next(); wait != time.Second || s.Done() {
+		t.Fatalf("Next - expected the wait to be capped at %v, got %v", time.Second, wait)
+	}
+	advance(time.Second)
+	if !s.Done() {
+		t.Fatalf("Done - expected %v once %v have elapsed, got %v", true, 5*time.Second, false)
+	}
+}
+
+func TestSimpleRetryStrategy_retriesFiveTimes(t *testing.T) {
+	s := SimpleRetryStrategy{}
+	retries := 0
+	for !s.Done() {
+		s.Next()
+		retries++
+	}
+	if retries != 5 {
+		t.Fatalf("SimpleRetryStrategy - expected %v retries, got %v", 5, retries)
+	}
+}
+
+func TestGetResponse_givesUpAfterMaxAttempts(t *testing.T) {
+	requests := 0
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		resp.Write([]byte(`{"error": {"code": -32000, "message": "Server error"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+
+	policy := MethodPolicy{
+		Timeout: time.Second,
+		Backoff: &BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 2, MaxInterval: time.Millisecond, MaxAttempts: 3},
+	}
+	_, err := getResponse[*ForkChoiceUpdatedResult](context.Background(), &TestRpcClient, NewRequest(FORK_CHOICE_UPDATED, &commands.ForkChoiceState{}), policy)
+	if rpcErr, ok := err.(*JsonRpcError); !ok || rpcErr.Code != CODE_SERVER_ERROR {
+		t.Fatalf("getResponse - expected code %v, got %v", CODE_SERVER_ERROR, err)
+	}
+	if requests != 3 {
+		t.Fatalf("getResponse - expected %v attempts, got %v", 3, requests)
+	}
+}
@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regent/utils"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+// A request in a batch, along with its outcome
+type BatchElem struct {
+	Request *Request
+	// A pointer to the value which the result of the request is unmarshalled into
+	Result interface{}
+	// Set if this request failed. Either the JsonRpcError returned by the execution client, a ResponseIdMismatchError
+	// if the batch response had no entry for the request, or an error if the entry couldn't be unmarshalled
+	Error error
+}
+
+// The entry for one request in the response to a batch
+type batchResponse struct {
+	Result json.RawMessage `json:"result"`
+	Id     *uint64         `json:"id"`
+	Error  *JsonRpcError   `json:"error"`
+}
+
+// Sends the requests in a single message, and records the outcome of each one in its entry.
+// The returned error is only set if the batch as a whole failed, in which case the entries are left untouched
+func (client *Client) SendBatch(ctx context.Context, batch []BatchElem) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	policy := client.batchPolicy(batch)
+	retries := policy.retryStrategy(client.Clock())
+	for attempt := 0; ; attempt++ {
+		// A late response to an earlier attempt must not be mistaken for a response to this one
+		if attempt > 0 {
+			for _, elem := range batch {
+				elem.Request.Id = nextRequestId()
+			}
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, policy.timeout())
+		err := client.sendBatch(attemptCtx, batch)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			return ErrFrom(ERR_REQUEST_CANCELLED, ctx.Err())
+		}
+		if err == nil {
+			return nil
+		}
+		log.Warn("Error sending batch to execution client", "err", err, "size", len(batch))
+		if !policy.isRetryable(err) || retries.Done() {
+			return err
+		}
+		if err := Sleep(ctx, client.Clock(), retries.Next()); err != nil {
+			return err
+		}
+	}
+}
+
+// How a batch is sent. A batch is sent as a single message, so each attempt is allowed as long as its slowest
+// request, and the batch is only retried while the policy of every request in it would retry
+type batchPolicy []MethodPolicy
+
+// The policies of the distinct methods in the batch
+func (client *Client) batchPolicy(batch []BatchElem) batchPolicy {
+	policies := make(batchPolicy, 0, 1)
+	seen := make(map[RpcMethod]bool)
+	for _, elem := range batch {
+		if !seen[elem.Request.Method] {
+			seen[elem.Request.Method] = true
+			policies = append(policies, client.Policy(elem.Request.Method))
+		}
+	}
+	return policies
+}
+
+func (p batchPolicy) timeout() time.Duration {
+	var timeout time.Duration
+	for _, policy := range p {
+		if policy.Timeout > timeout {
+			timeout = policy.Timeout
+		}
+	}
+	return timeout
+}
+
+func (p batchPolicy) isRetryable(err error) bool {
+	for _, policy := range p {
+		if !policy.isRetryable(err) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p batchPolicy) retryStrategy(clock utils.Clock) RetryStrategy {
+	strategies := make(conservativeRetryStrategy, len(p))
+	for i, policy := range p {
+		strategies[i] = policy.retryStrategy(clock)
+	}
+	return strategies
+}
+
+// Gives up as soon as any of its strategies would, and otherwise waits as long as the most patient of them
+type conservativeRetryStrategy []RetryStrategy
+
+func (s conservativeRetryStrategy) Next() time.Duration {
+	var wait time.Duration
+	for _, strategy := range s {
+		if next := strategy.Next(); next > wait {
+			wait = next
+		}
+	}
+	return wait
+}
+
+func (s conservativeRetryStrategy) Done() bool {
+	for _, strategy := range s {
+		if strategy.Done() {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *Client) sendBatch(ctx context.Context, batch []BatchElem) error {
+	requests := make([]*Request, len(batch))
+	for i, elem := range batch {
+		requests[i] = elem.Request
+	}
+	body, err := client.send(ctx, requests)
+	if err != nil {
+		return err
+	}
+
+	responses := make([]batchResponse, 0, len(batch))
+	if err := json.Unmarshal(body, &responses); err != nil {
+		// If the batch as a whole is rejected, the execution client replies with a single error
+		var single batchResponse
+		if json.Unmarshal(body, &single) == nil && single.Error != nil {
+			return single.Error
+		}
+		return ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("Error unmarshalling response to batch of %d requests. response body %v. err %w", len(batch), string(body), err))
+	}
+
+	// Responses may arrive in any order, so they are matched with their requests by id
+	byId := make(map[uint64]batchResponse, len(responses))
+	for _, response := range responses {
+		if response.Id == nil {
+			log.Warn("Ignoring a batch response without an id", "err", response.Error)
+			continue
+		}
+		byId[*response.Id] = response
+	}
+	for i := range batch {
+		elem := &batch[i]
+		response, ok := byId[elem.Request.Id]
+		elem.Error = nil
+		switch {
+		case !ok:
+			elem.Error = &ResponseIdMismatchError{Method: elem.Request.Method, Expected: elem.Request.Id}
+		case response.Error != nil:
+			elem.Error = response.Error
+		case len(response.Result) == 0 || string(response.Result) == "null":
+			elem.Error = ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("The response to msg %v did not contain a result", elem.Request))
+		default:
+			if err := json.Unmarshal(response.Result, elem.Result); err != nil {
+				elem.Error = ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("Error unmarshalling response to msg %v. result %v. err %w", elem.Request, string(response.Result), err))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regent/utils/test"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// Answers a batch of fork choice updates in reverse order. Each head is echoed as the latest valid hash,
+// except for the zero hash, which gets an error, and the hash 0x..ff, which gets no response at all
+func respondToBatch(body []byte) []byte {
+	var requests []struct {
+		Id     uint64                     `json:"id"`
+		Params []commands.ForkChoiceState `json:"params"`
+	}
+	if err := json.Unmarshal(body, &requests); err != nil {
+		return []byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32600, "message": "Invalid request"}}`)
+	}
+	responses := make([]string, 0)
+	for i := len(requests) - 1; i >= 0; i-- {
+		head := requests[i].Params[0].HeadHash
+		switch head {
+		case common.Hash{}:
+			responses = append(responses, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "error": {"code": -38002, "message": "Invalid forkchoice state"}}`, requests[i].Id))
+		case common.HexToHash("0xff"):
+		default:
+			responses = append(responses, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "result": {"payloadStatus": {"status": "VALID", "latestValidHash": "%v", "validationError": null}, "payloadId": null}}`, requests[i].Id, head.Hex()))
+		}
+	}
+	return []byte("[" + strings.Join(responses, ",") + "]")
+}
+
+func forkChoiceBatch(heads ...common.Hash) []BatchElem {
+	batch := make([]BatchElem, len(heads))
+	for i, head := range heads {
+		batch[i] = BatchElem{Request: NewRequest(FORK_CHOICE_UPDATED, &commands.ForkChoiceState{HeadHash: head}), Result: &ForkChoiceUpdatedResult{}}
+	}
+	return batch
+}
+
+func checkBatch(t *testing.T, batch []BatchElem) {
+	for i, head := range []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")} {
+		result := batch[i].Result.(*ForkChoiceUpdatedResult)
+		if batch[i].Error != nil || *result.PayloadStatus.LatestValidHash != head {
+			t.Errorf("SendBatch - expected the result for %v, got %+v. err %v", head, result.PayloadStatus, batch[i].Error)
+		}
+	}
+	if rpcErr, ok := batch[2].Error.(*JsonRpcError); !ok || rpcErr.Code != CODE_INVALID_FORKCHOICE_STATE {
+		t.Errorf("SendBatch - expected code %v, got %v", CODE_INVALID_FORKCHOICE_STATE, batch[2].Error)
+	}
+	if _, ok := batch[3].Error.(*ResponseIdMismatchError); !ok {
+		t.Errorf("SendBatch - expected a missing response, got %v", batch[3].Error)
+	}
+}
+
+func TestSendBatch_http(t *testing.T) {
+	requests := 0
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		resp.Write(respondToBatch(test.TestHandler.LastRequest()))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+
+	batch := forkChoiceBatch(common.HexToHash("0x01"), common.HexToHash("0x02"), common.Hash{}, common.HexToHash("0xff"))
+	if err := TestRpcClient.SendBatch(context.Background(), batch); err != nil {
+		t.Fatalf("SendBatch - expected %v, got %v", nil, err)
+	}
+	if requests != 1 {
+		t.Fatalf("SendBatch - expected a single request, got %v", requests)
+	}
+	checkBatch(t, batch)
+}
+
+func TestSendBatch_rejected(t *testing.T) {
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32600, "message": "Batch too large"}}`))
+	batch := forkChoiceBatch(common.HexToHash("0x01"))
+	err := TestRpcClient.SendBatch(context.Background(), batch)
+	if rpcErr, ok := err.(*JsonRpcError); !ok || rpcErr.Code != -32600 {
+		t.Fatalf("SendBatch - expected the batch to be rejected, got %v", err)
+	}
+	if batch[0].Error != nil {
+		t.Fatalf("SendBatch - expected the entry to be untouched, got %v", batch[0].Error)
+	}
+}
+
+func TestSendBatch_websocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(resp, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			_, body, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(websocket.TextMessage, respondToBatch(body))
+		}
+	}))
+	defer server.Close()
+	client, _ := NewClientFromUrl("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	defer client.Close()
+
+	batch := forkChoiceBatch(common.HexToHash("0x01"), common.HexToHash("0x02"), common.Hash{}, common.HexToHash("0xff"))
+	if err := client.SendBatch(context.Background(), batch); err != nil {
+		t.Fatalf("SendBatch - expected %v, got %v", nil, err)
+	}
+	checkBatch(t, batch)
+}
+
+func TestSendBatch_mostConservativePolicy(t *testing.T) {
+	requests := 0
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		time.Sleep(20 * time.Millisecond)
+		resp.Write([]byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32000, "message": "Server error"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	client := TestRpcClient
+	client.policies = nil
+	backoff := BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 1, MaxInterval: time.Millisecond}
+	impatient, patient := backoff, backoff
+	impatient.MaxAttempts, patient.MaxAttempts = 5, 2
+	client.SetPolicy(FORK_CHOICE_UPDATED, MethodPolicy{Timeout: time.Millisecond, Backoff: &impatient})
+	client.SetPolicy(FORK_CHOICE_UPDATED_V2, MethodPolicy{Timeout: time.Second, Backoff: &patient})
+	batch := forkChoiceBatch(common.HexToHash("0x01"), common.HexToHash("0x02"))
+	batch[1].Request.Method = FORK_CHOICE_UPDATED_V2
+
+	// Each attempt waits for the slower request, and the batch gives up after the fewer attempts
+	err := client.SendBatch(context.Background(), batch)
+	if rpcErr, ok := err.(*JsonRpcError); !ok || rpcErr.Code != -32000 || requests != 2 {
+		t.Fatalf("SendBatch - expected %v attempts to fail with a server error, got %v. err %v", 2, requests, err)
+	}
+
+	// The batch isn't retried if any of its requests isn't worth retrying
+	requests = 0
+	client.SetPolicy(FORK_CHOICE_UPDATED_V2, MethodPolicy{Timeout: time.Second, Backoff: &patient, Retryable: func(error) bool { return false }})
+	if err := client.SendBatch(context.Background(), batch); err == nil || requests != 1 {
+		t.Fatalf("SendBatch - expected a single attempt, got %v. err %v", requests, err)
+	}
+}
@@ -0,0 +1,197 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regent/utils"
+	"sync"
+	"time"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+type BreakerState int
+
+const (
+	// Requests are sent as usual
+	BREAKER_CLOSED BreakerState = iota
+	// The execution client is unreachable. Requests fail without being sent until the cooldown has passed
+	BREAKER_OPEN
+	// The cooldown has passed. A single request is sent to find out whether the execution client is back
+	BREAKER_HALF_OPEN
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BREAKER_CLOSED:
+		return "closed"
+	case BREAKER_OPEN:
+		return "open"
+	case BREAKER_HALF_OPEN:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+type BreakerConfig struct {
+	// The number of consecutive attempts which must fail to reach the execution client before the breaker opens
+	FailureThreshold int
+	// The time the breaker stays open before it lets a request through
+	Cooldown time.Duration
+}
+
+var DEFAULT_BREAKER = BreakerConfig{
+	FailureThreshold: 5,
+	Cooldown:         10 * time.Second,
+}
+
+// Stops requests from being sent while the execution client is unreachable, so that callers fail fast instead of
+// each retrying on their own. Only failures to reach the execution client count. A JSON-RPC error shows that it is up.
+// A nil breaker is always closed
+type CircuitBreaker struct {
+	config BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// Whether the request which decides the outcome of the half-open state is in flight
+	probing bool
+	// Incremented whenever the state changes. A request only counts towards the state it was let through in
+	generation uint64
+	// The time according to the client's clock. Overridden in tests
+	now func() time.Time
+}
+
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{config: config, now: time.Now}
+}
+
+// The state of the breaker. An open breaker whose cooldown has passed is reported as half-open
+func (b *CircuitBreaker) State() BreakerState {
+	if b == nil {
+		return BREAKER_CLOSED
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BREAKER_OPEN && b.retryAfter() == 0 {
+		return BREAKER_HALF_OPEN
+	}
+	return b.state
+}
+
+// The time until the breaker lets a request through, or zero if it does now
+func (b *CircuitBreaker) RetryAfter() time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.retryAfter()
+}
+
+// Must be called with the lock held
+func (b *CircuitBreaker) retryAfter() time.Duration {
+	if b.state != BREAKER_OPEN {
+		return 0
+	}
+	if wait := b.config.Cooldown - b.now().Sub(b.openedAt); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// Returns an error if a request must not be sent. Otherwise the outcome of the request must be passed to record,
+// along with the returned generation
+func (b *CircuitBreaker) allow() (uint64, error) {
+	if b == nil {
+		return 0, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if wait := b.retryAfter(); wait > 0 {
+		return 0, ErrFrom(ERR_CIRCUIT_OPEN, fmt.Errorf("retrying in %v", wait))
+	}
+	if b.state == BREAKER_OPEN {
+		b.setState(BREAKER_HALF_OPEN)
+	}
+	if b.state == BREAKER_HALF_OPEN {
+		if b.probing {
+			return 0, ErrFrom(ERR_CIRCUIT_OPEN, errors.New("waiting for the outcome of a probe"))
+		}
+		b.probing = true
+	}
+	return b.generation, nil
+}
+
+// Records the outcome of a request which was allowed in the given generation. The outcome of a request which was
+// let through before the state last changed is ignored, e.g. a success from before the breaker opened, since only a
+// probe may close it
+func (b *CircuitBreaker) record(generation uint64, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if generation != b.generation {
+		return
+	}
+	b.probing = false
+	switch {
+	case errors.Is(err, context.Canceled):
+		// The caller gave up, which says nothing about the execution client
+	case isUnreachable(err):
+		b.failures++
+		if b.state == BREAKER_HALF_OPEN || b.failures >= b.config.FailureThreshold {
+			b.openedAt = b.now()
+			b.setState(BREAKER_OPEN)
+		}
+	default:
+		b.failures = 0
+		b.setState(BREAKER_CLOSED)
+	}
+}
+
+// Must be called with the lock held
+func (b *CircuitBreaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	switch state {
+	case BREAKER_OPEN:
+		log.Warn("The execution client is unreachable. Failing requests until it is back", "failures", b.failures, "cooldown", b.config.Cooldown)
+	case BREAKER_CLOSED:
+		log.Info("The execution client is reachable again")
+	}
+	b.state = state
+	b.generation++
+}
+
+// Whether an error shows that the execution client could not be reached, rather than that it rejected a request
+func isUnreachable(err error) bool {
+	var rpcErr *NonProtocolRpcError
+	return errors.As(err, &rpcErr) && (rpcErr.msg == ERR_REQUEST_SEND_FAILED || rpcErr.msg == ERR_RESPONSE_READ_FAILED)
+}
+
+// Measures the cooldown on the given clock
+func (b *CircuitBreaker) setClock(clock utils.Clock) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.now = clock.Now
+}
+
+// Makes the client's requests go through the given breaker, whose cooldown is measured on the client's clock.
+// Nil removes the breaker
+func (client *Client) SetBreaker(breaker *CircuitBreaker) {
+	client.breaker = breaker
+	breaker.setClock(client.Clock())
+}
+
+// The client's circuit breaker, or nil if it has none
+func (client *Client) Breaker() *CircuitBreaker {
+	return client.breaker
+}
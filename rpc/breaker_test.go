@@ -0,0 +1,137 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+)
+
+var errUnreachable = ErrFrom(ERR_REQUEST_SEND_FAILED, errors.New("connection refused"))
+
+// Returns a breaker which opens after two failures, and a function which advances its clock
+func testBreaker() (*CircuitBreaker, func(time.Duration)) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, Cooldown: time.Second})
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	return b, func(d time.Duration) { now = now.Add(d) }
+}
+
+func fail(t *testing.T, b *CircuitBreaker, err error) {
+	generation, allowErr := b.allow()
+	if allowErr != nil {
+		t.Fatalf("allow - expected %v, got %v", nil, allowErr)
+	}
+	b.record(generation, err)
+}
+
+func TestCircuitBreaker_opensAfterThreshold(t *testing.T) {
+	b, _ := testBreaker()
+	fail(t, b, errUnreachable)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("State - expected %v, got %v", BREAKER_CLOSED, b.State())
+	}
+	fail(t, b, errUnreachable)
+	if b.State() != BREAKER_OPEN || b.RetryAfter() != time.Second {
+		t.Fatalf("State - expected %v for %v, got %v for %v", BREAKER_OPEN, time.Second, b.State(), b.RetryAfter())
+	}
+	if _, err := b.allow(); !test.ErrorIs(err, ERR_CIRCUIT_OPEN) || IsRetryable(err) {
+		t.Fatalf("allow - expected a non-retryable %v, got %v", ERR_CIRCUIT_OPEN, err)
+	}
+}
+
+func TestCircuitBreaker_onlyCountsUnreachable(t *testing.T) {
+	b, _ := testBreaker()
+	fail(t, b, errUnreachable)
+	// A JSON-RPC error shows that the execution client is up
+	fail(t, b, &JsonRpcError{Code: CODE_SERVER_ERROR})
+	fail(t, b, errUnreachable)
+	fail(t, b, ErrFrom(ERR_REQUEST_SEND_FAILED, context.Canceled))
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("State - expected %v, got %v", BREAKER_CLOSED, b.State())
+	}
+	// Wrapping doesn't hide a failure to reach the execution client
+	fail(t, b, fmt.Errorf("unable to update the fork choice: %w", errUnreachable))
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("State - expected %v, got %v", BREAKER_OPEN, b.State())
+	}
+}
+
+func TestCircuitBreaker_halfOpen(t *testing.T) {
+	b, advance := testBreaker()
+	fail(t, b, errUnreachable)
+	fail(t, b, errUnreachable)
+	advance(time.Second)
+	if b.State() != BREAKER_HALF_OPEN || b.RetryAfter() != 0 {
+		t.Fatalf("State - expected %v, got %v", BREAKER_HALF_OPEN, b.State())
+	}
+
+	// A single probe is let through, and its failure reopens the breaker
+	generation, err := b.allow()
+	if err != nil {
+		t.Fatalf("allow - expected %v, got %v", nil, err)
+	}
+	if _, err := b.allow(); !test.ErrorIs(err, ERR_CIRCUIT_OPEN) {
+		t.Fatalf("allow - expected %v while probing, got %v", ERR_CIRCUIT_OPEN, err)
+	}
+	b.record(generation, errUnreachable)
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("State - expected %v, got %v", BREAKER_OPEN, b.State())
+	}
+
+	// A successful probe closes it
+	advance(time.Second)
+	fail(t, b, nil)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("State - expected %v, got %v", BREAKER_CLOSED, b.State())
+	}
+}
+
+func TestCircuitBreaker_ignoresStaleOutcomes(t *testing.T) {
+	b, advance := testBreaker()
+	// A request which was let through before the breaker opened succeeds after it did
+	stale, _ := b.allow()
+	fail(t, b, errUnreachable)
+	fail(t, b, errUnreachable)
+	b.record(stale, nil)
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("State - expected %v, got %v", BREAKER_OPEN, b.State())
+	}
+
+	// Nor does it decide the outcome of a probe
+	advance(time.Second)
+	probe, _ := b.allow()
+	b.record(stale, nil)
+	if _, err := b.allow(); !test.ErrorIs(err, ERR_CIRCUIT_OPEN) {
+		t.Fatalf("allow - expected %v while probing, got %v", ERR_CIRCUIT_OPEN, err)
+	}
+	b.record(probe, nil)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("State - expected %v, got %v", BREAKER_CLOSED, b.State())
+	}
+}
+
+func TestUpdateForkChoice_failsFastWhenBreakerOpen(t *testing.T) {
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	server := httptest.NewServer(nil)
+	server.Close()
+	client := NewClient("8545")
+	client.SetEndpoint(server.URL)
+	breaker, _ := testBreaker()
+	client.SetBreaker(breaker)
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
+			t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
+		}
+	}
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_CIRCUIT_OPEN) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_CIRCUIT_OPEN, err)
+	}
+}
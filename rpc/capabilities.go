@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const EXCHANGE_CAPABILITIES RpcMethod = "engine_exchangeCapabilities"
+const EXCHANGE_TRANSITION_CONFIGURATION RpcMethod = "engine_exchangeTransitionConfigurationV1"
+
+// The versions of each Engine API method which Regent knows how to call
+var forkChoiceUpdatedMethods = map[EngineVersion]RpcMethod{
+	ENGINE_V1: FORK_CHOICE_UPDATED,
+	ENGINE_V2: FORK_CHOICE_UPDATED_V2,
+	ENGINE_V3: FORK_CHOICE_UPDATED_V3,
+}
+var newPayloadMethods = map[EngineVersion]RpcMethod{
+	ENGINE_V1: NEW_EXECUTION_PAYLOAD,
+	ENGINE_V2: NEW_EXECUTION_PAYLOAD_V2,
+	ENGINE_V3: NEW_EXECUTION_PAYLOAD_V3,
+}
+var getPayloadMethods = map[EngineVersion]RpcMethod{
+	ENGINE_V1: GET_EXECUTION_PAYLOAD,
+	ENGINE_V2: GET_EXECUTION_PAYLOAD_V2,
+	ENGINE_V3: GET_EXECUTION_PAYLOAD_V3,
+}
+
+// The Engine API methods supported by Regent, which are advertised to the execution client
+func SupportedMethods() []RpcMethod {
+	methods := make([]RpcMethod, 0)
+	for _, family := range []map[EngineVersion]RpcMethod{forkChoiceUpdatedMethods, newPayloadMethods, getPayloadMethods} {
+		for v := ENGINE_V1; v <= ENGINE_V3; v++ {
+			methods = append(methods, family[v])
+		}
+	}
+	return methods
+}
+
+// Returns the range of method versions which accept the structures of the given fork.
+// V2 methods also accept V1 structures, but V3 methods only accept V3 structures.
+func acceptedVersions(fork EngineVersion) (EngineVersion, EngineVersion) {
+	if fork == ENGINE_V1 {
+		return ENGINE_V1, ENGINE_V2
+	}
+	return fork, fork
+}
+
+// Records the Engine API methods supported by the execution client. A nil list means that capabilities
+// have not been negotiated, in which case the client is assumed to support every method enabled by the fork schedule.
+func (client *Client) SetCapabilities(methods []RpcMethod) {
+	if methods == nil {
+		client.capabilities = nil
+		return
+	}
+	client.capabilities = make(map[RpcMethod]bool)
+	for _, method := range methods {
+		client.capabilities[method] = true
+	}
+}
+
+func (client *Client) supports(method RpcMethod, version EngineVersion) bool {
+	if client.capabilities == nil {
+		return version <= client.Forks.LatestVersion()
+	}
+	return client.capabilities[method]
+}
+
+// Picks the highest version of a method between min and max which is supported by both clients
+func (client *Client) selectMethod(versions map[EngineVersion]RpcMethod, min EngineVersion, max EngineVersion) (RpcMethod, error) {
+	for v := max; v >= min; v-- {
+		if method, ok := versions[v]; ok && client.supports(method, v) {
+			return method, nil
+		}
+	}
+	return "", ErrFrom(ERR_NO_COMPATIBLE_METHOD, fmt.Errorf("the execution client supports none of %v through %v", versions[min], versions[max]))
+}
+
+// Picks the highest version of a method which accepts the structures of the given fork and is supported by both clients
+func (client *Client) selectMethodForFork(versions map[EngineVersion]RpcMethod, fork EngineVersion) (RpcMethod, error) {
+	min, max := acceptedVersions(fork)
+	return client.selectMethod(versions, min, max)
+}
+
+// Asks the execution client which Engine API methods it supports using engine_exchangeCapabilities.
+// Clients which predate that method support only the V1 methods, which is detected with engine_exchangeTransitionConfigurationV1.
+func (client *Client) ExchangeCapabilities(ctx context.Context) ([]RpcMethod, error) {
+	methods, err := getResponse[*[]RpcMethod](ctx, client, NewRequest(EXCHANGE_CAPABILITIES, SupportedMethods()), client.Policy(EXCHANGE_CAPABILITIES))
+	if err == nil {
+		return *methods, nil
+	}
+	if !errors.Is(err, ERR_METHOD_NOT_FOUND) {
+		return nil, err
+	}
+
+	log.Info("The execution client does not support engine_exchangeCapabilities. Falling back to engine_exchangeTransitionConfigurationV1")
+	// The rollup is post-merge from genesis, so the terminal block is the zero block
+	_, err = getResponse[*commands.TransitionConfiguration](ctx, client, NewRequest(EXCHANGE_TRANSITION_CONFIGURATION, &commands.TransitionConfiguration{
+		TerminalTotalDifficulty: new(hexutil.Big),
+		TerminalBlockNumber:     new(hexutil.Big),
+	}), client.Policy(EXCHANGE_TRANSITION_CONFIGURATION))
+	if err != nil {
+		return nil, err
+	}
+	return []RpcMethod{FORK_CHOICE_UPDATED, NEW_EXECUTION_PAYLOAD, GET_EXECUTION_PAYLOAD}, nil
+}
+
+// Exchanges capabilities with the execution client and records the result. Returns an error if the execution client
+// lacks a compatible version of any method required by the fork schedule
+func (client *Client) NegotiateCapabilities(ctx context.Context) error {
+	methods, err := client.ExchangeCapabilities(ctx)
+	if err != nil {
+		return err
+	}
+	client.SetCapabilities(methods)
+	log.Info("Negotiated Engine API capabilities", "methods", methods)
+
+	for fork := client.Forks.VersionAt(0); fork <= client.Forks.LatestVersion(); fork++ {
+		for _, family := range []map[EngineVersion]RpcMethod{forkChoiceUpdatedMethods, newPayloadMethods, getPayloadMethods} {
+			if _, err := client.selectMethodForFork(family, fork); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
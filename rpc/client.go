@@ -1,26 +1,81 @@
 package rpc
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"regent/rpc/jwt"
-	"time"
+	"regent/utils"
 
 	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
 )
 
 type Client struct {
 	authToken *jwt.EthJwt
-	Endpoint  string
+	endpoint  string
+	// Determines which structures are sent to the Engine API for a given payload
+	Forks ForkSchedule
+	// The Engine API methods supported by the execution client, or nil if they have not been negotiated
+	capabilities map[RpcMethod]bool
+	// The TLS configuration of an https or wss endpoint, or nil to use the defaults
+	tlsConfig *tls.Config
+	// Carries messages to the endpoint. Chosen by the scheme of the endpoint when it is set
+	transport Transport
+	// Overrides of DefaultPolicies, keyed by method
+	policies map[RpcMethod]MethodPolicy
+	// Stops requests while the execution client is unreachable, or nil to always send them
+	breaker *CircuitBreaker
+	// The clock used to wait between retries, or nil to use the wall clock
+	clock utils.Clock
 }
 
 var DefaultRetryStrategy = func() RetryStrategy {
-	return &SimpleRetryStrategy{}
+	return NewExponentialBackoffStrategy(DEFAULT_BACKOFF)
 }
 
+// Creates a client for an execution client listening on the given port of localhost.
+// Use NewClientFromUrl to reach a remote or TLS endpoint
 func NewClient(port string) Client {
-	return Client{
-		Endpoint: fmt.Sprintf("http://localhost:%v", port),
+	client := Client{}
+	client.SetEndpoint(fmt.Sprintf("http://localhost:%v", port))
+	return client
+}
+
+// The URL of the execution client's Engine API
+func (client *Client) Endpoint() string {
+	return client.endpoint
+}
+
+// Points the client at another endpoint, keeping its TLS configuration. The connection to the previous endpoint,
+// if it has one, is closed
+func (client *Client) SetEndpoint(endpoint string) {
+	client.Close()
+	client.endpoint = endpoint
+	client.transport = newTransport(endpoint, client.tlsConfig)
+}
+
+// Makes the client wait between retries, and its breaker measure its cooldown, on the given clock.
+// Nil restores the wall clock
+func (client *Client) SetClock(clock utils.Clock) {
+	client.clock = clock
+	client.breaker.setClock(client.Clock())
+}
+
+// The clock the client waits on
+func (client *Client) Clock() utils.Clock {
+	if client.clock == nil {
+		return utils.SystemClock
 	}
+	return client.clock
+}
+
+// Closes the client's persistent connection, if it has one
+func (client *Client) Close() error {
+	if ws, ok := client.transport.(*WsTransport); ok {
+		return ws.Close()
+	}
+	return nil
 }
 
 func (client *Client) SetAuthToken(newToken *jwt.EthJwt) {
@@ -34,24 +89,105 @@ func NewClientWithJwt(port string, secret []byte) Client {
 }
 
 // Updates the execution client's current head.
-func (client *Client) UpdateForkChoice(forkChoice *commands.ForkChoiceState) (*ForkChoiceUpdatedResult, error) {
-	return getResponse[*ForkChoiceUpdatedResult](client, NewRequest(FORK_CHOICE_UPDATED, forkChoice), 8*time.Second, DefaultRetryStrategy())
+func (client *Client) UpdateForkChoice(ctx context.Context, forkChoice *commands.ForkChoiceState) (*ForkChoiceUpdatedResult, error) {
+	msg, err := client.ForkChoiceRequest(forkChoice)
+	if err != nil {
+		return nil, err
+	}
+	return getResponse[*ForkChoiceUpdatedResult](ctx, client, msg, client.Policy(msg.Method))
 }
 
-// Updates the execution client's current head and starts the block building process
-func (client *Client) UpdateForkChoiceAndBuildBlock(forkChoice *commands.ForkChoiceState, payloadAttributes *commands.PayloadAttributes) (*ForkChoiceUpdatedResult, error) {
-	return getResponse[*ForkChoiceUpdatedResult](client, NewRequest(FORK_CHOICE_UPDATED, forkChoice, payloadAttributes), 8*time.Second, DefaultRetryStrategy())
+// The request sent by UpdateForkChoice, for use in a batch. Its result is a ForkChoiceUpdatedResult
+func (client *Client) ForkChoiceRequest(forkChoice *commands.ForkChoiceState) (*Request, error) {
+	// Every version accepts a fork choice update without payload attributes
+	method, err := client.selectMethod(forkChoiceUpdatedMethods, ENGINE_V1, ENGINE_V3)
+	if err != nil {
+		return nil, err
+	}
+	return NewRequest(method, forkChoice), nil
 }
 
-// Passes a new `execution payload` (block) to the execution client
-func (client *Client) SendExecutionPayload(payload *commands.ExecutionPayload) (*commands.PayloadAttributes, error) {
-	resp, err := getResponse[*commands.PayloadAttributes](client, NewRequest(NEW_EXECUTION_PAYLOAD, payload), 8*time.Second, DefaultRetryStrategy())
-	return resp, err
+// Updates the execution client's current head and starts the block building process.
+// The structure of the attributes is chosen based on their timestamp, and sent using
+// the highest version of the method which accepts it
+func (client *Client) UpdateForkChoiceAndBuildBlock(ctx context.Context, forkChoice *commands.ForkChoiceState, payloadAttributes *PayloadAttributesV3) (*ForkChoiceUpdatedResult, error) {
+	fork := client.Forks.VersionAt(uint64(payloadAttributes.Timestamp))
+	method, err := client.selectMethodForFork(forkChoiceUpdatedMethods, fork)
+	if err != nil {
+		return nil, err
+	}
+	var msg *Request
+	switch fork {
+	case ENGINE_V1:
+		msg = NewRequest(method, forkChoice, &payloadAttributes.PayloadAttributes)
+	case ENGINE_V2:
+		msg = NewRequest(method, forkChoice, payloadAttributes.PayloadAttributesV2.withWithdrawals())
+	default:
+		attributes := *payloadAttributes
+		attributes.PayloadAttributesV2 = *attributes.withWithdrawals()
+		msg = NewRequest(method, forkChoice, &attributes)
+	}
+	return getResponse[*ForkChoiceUpdatedResult](ctx, client, msg, client.Policy(method))
+}
+
+// Passes a new `execution payload` (block) to the execution client, and returns its verdict on the payload.
+// The structure of the payload is chosen based on its timestamp, and sent using the highest version of the method
+// which accepts it. The versioned hashes of the payload's blobs and the parent beacon block root are only sent
+// with V3 requests.
+func (client *Client) SendExecutionPayload(ctx context.Context, payload *ExecutionPayloadV3, versionedHashes []common.Hash, parentBeaconBlockRoot common.Hash) (*PayloadStatus, error) {
+	msg, err := client.ExecutionPayloadRequest(payload, versionedHashes, parentBeaconBlockRoot)
+	if err != nil {
+		return nil, err
+	}
+	return getResponse[*PayloadStatus](ctx, client, msg, client.Policy(msg.Method))
+}
+
+// The request sent by SendExecutionPayload, for use in a batch. Its result is a PayloadStatus
+func (client *Client) ExecutionPayloadRequest(payload *ExecutionPayloadV3, versionedHashes []common.Hash, parentBeaconBlockRoot common.Hash) (*Request, error) {
+	fork := client.Forks.VersionAt(uint64(payload.Timestamp))
+	method, err := client.selectMethodForFork(newPayloadMethods, fork)
+	if err != nil {
+		return nil, err
+	}
+	var msg *Request
+	switch fork {
+	case ENGINE_V1:
+		msg = NewRequest(method, &payload.ExecutionPayload)
+	case ENGINE_V2:
+		msg = NewRequest(method, payload.ExecutionPayloadV2.withWithdrawals())
+	default:
+		withWithdrawals := *payload
+		withWithdrawals.ExecutionPayloadV2 = *payload.withWithdrawals()
+		if versionedHashes == nil {
+			versionedHashes = make([]common.Hash, 0)
+		}
+		msg = NewRequest(method, &withWithdrawals, versionedHashes, parentBeaconBlockRoot)
+	}
+	return msg, nil
 }
 
 // Requests a new block ("execution payload") from the client. This method will fail if
-// the previous call was to UpdateForkChoice rather than UpdateForkChoiceAndBuildBlock
-func (client *Client) GetPayload(payloadId string) (*commands.ExecutionPayload, error) {
-	msg := NewRequest(GET_EXECUTION_PAYLOAD, payloadId)
-	return getResponse[*commands.ExecutionPayload](client, msg, 1*time.Second, DefaultRetryStrategy())
+// the previous call was to UpdateForkChoice rather than UpdateForkChoiceAndBuildBlock.
+// The timestamp must match the one in the payload attributes used to start the builder, since it determines the
+// version of the request
+func (client *Client) GetPayload(ctx context.Context, payloadId string, timestamp uint64) (*GetPayloadResult, error) {
+	method, err := client.selectMethodForFork(getPayloadMethods, client.Forks.VersionAt(timestamp))
+	if err != nil {
+		return nil, err
+	}
+	if method == GET_EXECUTION_PAYLOAD {
+		payload, err := getResponse[*commands.ExecutionPayload](ctx, client, NewRequest(method, payloadId), client.Policy(method))
+		if err != nil {
+			return nil, err
+		}
+		return &GetPayloadResult{ExecutionPayload: &ExecutionPayloadV3{ExecutionPayloadV2: ExecutionPayloadV2{ExecutionPayload: *payload}}}, nil
+	}
+	result, err := getResponse[*GetPayloadResult](ctx, client, NewRequest(method, payloadId), client.Policy(method))
+	if err != nil {
+		return nil, err
+	}
+	if result.ExecutionPayload == nil {
+		return nil, ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("the response to %v did not contain an execution payload", method))
+	}
+	return result, nil
 }
@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// Optional TLS settings for an https endpoint. Empty fields fall back to the system defaults
+type TlsOptions struct {
+	// PEM file containing the certificate authorities used to verify the execution client, in addition to the system roots
+	CAFile string
+	// PEM files containing the certificate and private key presented to an execution client which requires client authentication
+	CertFile string
+	KeyFile  string
+}
+
+func (o *TlsOptions) isEmpty() bool {
+	return o == nil || (o.CAFile == "" && o.CertFile == "" && o.KeyFile == "")
+}
+
+// Checks that the endpoint is an absolute http, https, ws or wss URL, or the ipc:// URL of a Unix socket
+func ValidateEndpoint(endpoint string) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return ErrFrom(ERR_INVALID_ENDPOINT, err)
+	}
+	if parsed.Scheme == IPC_SCHEME {
+		if path, _ := ipcPath(endpoint); path == "" {
+			return ErrFrom(ERR_INVALID_ENDPOINT, fmt.Errorf("no socket path in %v", endpoint))
+		}
+		return nil
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" && !isWsScheme(parsed.Scheme) {
+		return ErrFrom(ERR_INVALID_ENDPOINT, fmt.Errorf("unsupported scheme %q in %v. Use http, https, ws, wss or ipc", parsed.Scheme, endpoint))
+	}
+	if parsed.Host == "" {
+		return ErrFrom(ERR_INVALID_ENDPOINT, fmt.Errorf("no host in %v", endpoint))
+	}
+	return nil
+}
+
+func isWsScheme(scheme string) bool {
+	return scheme == "ws" || scheme == "wss"
+}
+
+// Creates a client for the Engine API at the given URL, which may be an http, https, ws, wss or ipc:// URL.
+// A ws or wss client keeps a single connection open, which is released by Close.
+// TLS options may only be provided for https and wss endpoints
+func NewClientFromUrl(endpoint string, tlsOptions *TlsOptions) (Client, error) {
+	if err := ValidateEndpoint(endpoint); err != nil {
+		return Client{}, err
+	}
+	parsed, _ := url.Parse(endpoint)
+	client := Client{}
+
+	if !tlsOptions.isEmpty() {
+		if parsed.Scheme != "https" && parsed.Scheme != "wss" {
+			return Client{}, ErrFrom(ERR_INVALID_ENDPOINT, fmt.Errorf("TLS options were provided for the unencrypted endpoint %v", endpoint))
+		}
+		var err error
+		client.tlsConfig, err = tlsOptions.load()
+		if err != nil {
+			return Client{}, err
+		}
+	}
+	client.SetEndpoint(endpoint)
+	return client, nil
+}
+
+// Reads the certificates referenced by the options
+func (o *TlsOptions) load() (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, ErrFrom(ERR_TLS_CONFIG_FAILED, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrFrom(ERR_TLS_CONFIG_FAILED, fmt.Errorf("no certificates found in %v", o.CAFile))
+		}
+		config.RootCAs = pool
+	}
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return nil, ErrFrom(ERR_TLS_CONFIG_FAILED, fmt.Errorf("a client certificate and key must be provided together"))
+	}
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, ErrFrom(ERR_TLS_CONFIG_FAILED, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
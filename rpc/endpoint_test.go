@@ -0,0 +1,140 @@
+package rpc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+)
+
+const forkChoiceResponse = `{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`
+
+// Writes the PEM encoding of the given DER bytes to a file in dir and returns its path
+func writePem(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("could not write %v: %v", path, err)
+	}
+	return path
+}
+
+// Creates a self-signed client certificate. Returns the certificate along with the paths of its PEM encoded cert and key
+func newClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create the client certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	return cert, writePem(t, dir, "client.crt", "CERTIFICATE", der), writePem(t, dir, "client.key", "EC PRIVATE KEY", keyDer)
+}
+
+func forkChoiceHandler() *test.MockHandler {
+	handler := &test.MockHandler{}
+	handler.SetResponse([]byte(forkChoiceResponse))
+	handler.SetEchoIds(true)
+	return handler
+}
+
+func newTlsServer() *httptest.Server {
+	return httptest.NewTLSServer(forkChoiceHandler())
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"http://localhost:8551", "https://engine.example.com", "http://10.0.0.2:8551/engine", "ipc:///tmp/erigon.ipc", "ws://localhost:8551", "wss://engine.example.com"} {
+		if err := ValidateEndpoint(endpoint); err != nil {
+			t.Errorf("ValidateEndpoint(%v) - expected %v, got %v", endpoint, nil, err)
+		}
+	}
+	for _, endpoint := range []string{"localhost:8551", "ftp://localhost:8546", "http://", "http://local host", "ipc://", ""} {
+		if err := ValidateEndpoint(endpoint); !test.ErrorIs(err, ERR_INVALID_ENDPOINT) {
+			t.Errorf("ValidateEndpoint(%v) - expected %v, got %v", endpoint, ERR_INVALID_ENDPOINT, err)
+		}
+	}
+}
+
+func TestNewClientFromUrl_tlsOptionsRequireHttps(t *testing.T) {
+	_, err := NewClientFromUrl("http://localhost:8551", &TlsOptions{CAFile: "ca.pem"})
+	if !test.ErrorIs(err, ERR_INVALID_ENDPOINT) {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", ERR_INVALID_ENDPOINT, err)
+	}
+	_, err = NewClientFromUrl("https://localhost:8551", &TlsOptions{CertFile: "client.crt"})
+	if !test.ErrorIs(err, ERR_TLS_CONFIG_FAILED) {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", ERR_TLS_CONFIG_FAILED, err)
+	}
+}
+
+func TestNewClientFromUrl_customCA(t *testing.T) {
+	server := newTlsServer()
+	defer server.Close()
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+
+	// Without the server's CA, the certificate can't be verified
+	untrusted, err := NewClientFromUrl(server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", nil, err)
+	}
+	if _, err = untrusted.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
+	}
+
+	caFile := writePem(t, t.TempDir(), "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	client, err := NewClientFromUrl(server.URL, &TlsOptions{CAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", nil, err)
+	}
+	if _, err = client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); err != nil {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", nil, err)
+	}
+}
+
+func TestNewClientFromUrl_clientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	clientCert, certFile, keyFile := newClientCert(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+
+	server := httptest.NewUnstartedServer(forkChoiceHandler())
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+
+	caFile := writePem(t, dir, "ca.pem", "CERTIFICATE", server.Certificate().Raw)
+	anonymous, _ := NewClientFromUrl(server.URL, &TlsOptions{CAFile: caFile})
+	if _, err := anonymous.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
+	}
+
+	client, err := NewClientFromUrl(server.URL, &TlsOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", nil, err)
+	}
+	if _, err = client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); err != nil {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", nil, err)
+	}
+}
@@ -5,12 +5,46 @@ import (
 	"strings"
 )
 
-// https://github.com/ethereum/execution-apis/blob/main/src/engine/specification.md#Errors
+// https://github.com/ethereum/execution-apis/blob/main/src/engine/common.md#errors
+// and https://www.jsonrpc.org/specification#error_object
 const (
+	CODE_PARSE_ERROR                = -32700
+	CODE_INVALID_REQUEST            = -32600
+	CODE_METHOD_NOT_FOUND           = -32601
+	CODE_INVALID_PARAMS             = -32602
 	CODE_INTERNAL_ERROR             = -32603
 	CODE_SERVER_ERROR               = -32000
-	CODE_INVALID_PAYLOAD_ATTRIBUTES = -38003
+	CODE_UNKNOWN_PAYLOAD            = -38001
 	CODE_INVALID_FORKCHOICE_STATE   = -38002
+	CODE_INVALID_PAYLOAD_ATTRIBUTES = -38003
+	CODE_TOO_LARGE_REQUEST          = -38004
+	CODE_UNSUPPORTED_FORK           = -38005
+)
+
+// Sentinels for each error code, which match any JsonRpcError with the same code under errors.Is
+var (
+	// The execution client could not parse the JSON which was sent. This indicates a consensus client bug
+	ERR_PARSE_ERROR = &JsonRpcError{Code: CODE_PARSE_ERROR, Message: "Parse error"}
+	// The JSON sent is not a valid request object. This indicates a consensus client bug
+	ERR_INVALID_REQUEST = &JsonRpcError{Code: CODE_INVALID_REQUEST, Message: "Invalid Request"}
+	// The execution client does not support the method
+	ERR_METHOD_NOT_FOUND = &JsonRpcError{Code: CODE_METHOD_NOT_FOUND, Message: "Method not found"}
+	// The parameters of the request were invalid. This indicates a consensus client bug
+	ERR_INVALID_PARAMS = &JsonRpcError{Code: CODE_INVALID_PARAMS, Message: "Invalid params"}
+	// The execution client failed while handling the request
+	ERR_INTERNAL_ERROR = &JsonRpcError{Code: CODE_INTERNAL_ERROR, Message: "Internal error"}
+	// The execution client failed while handling the request, for a reason specific to its implementation
+	ERR_SERVER_ERROR = &JsonRpcError{Code: CODE_SERVER_ERROR, Message: "Server error"}
+	// The execution client is not building, or no longer has, the payload with the requested id
+	ERR_UNKNOWN_PAYLOAD = &JsonRpcError{Code: CODE_UNKNOWN_PAYLOAD, Message: "Unknown payload"}
+	// The fork choice state is inconsistent, e.g. the finalized block is not an ancestor of the head
+	ERR_INVALID_FORKCHOICE_STATE = &JsonRpcError{Code: CODE_INVALID_FORKCHOICE_STATE, Message: "Invalid forkchoice state"}
+	// The fork choice was applied, but no payload is being built because the payload attributes were invalid
+	ERR_INVALID_PAYLOAD_ATTRIBUTES = &JsonRpcError{Code: CODE_INVALID_PAYLOAD_ATTRIBUTES, Message: "Invalid payload attributes"}
+	// The request asked for more items than the execution client serves at once
+	ERR_TOO_LARGE_REQUEST = &JsonRpcError{Code: CODE_TOO_LARGE_REQUEST, Message: "Too large request"}
+	// The version of the method does not match the fork of the payload or attributes it was sent
+	ERR_UNSUPPORTED_FORK = &JsonRpcError{Code: CODE_UNSUPPORTED_FORK, Message: "Unsupported fork"}
 )
 
 const (
@@ -20,6 +54,11 @@ const (
 	ERR_REQUEST_SEND_FAILED           = "an error was encountered while sending the http request"
 	ERR_RESPONSE_READ_FAILED          = "an error was encountered while sending the http request"
 	ERR_UNMARSHALLING_FAILED          = "unmarshalling failed"
+	ERR_NO_COMPATIBLE_METHOD          = "the execution client does not support a compatible version of the Engine API method"
+	ERR_INVALID_ENDPOINT              = "the engine endpoint is not a valid http, https, ws, wss or ipc URL"
+	ERR_TLS_CONFIG_FAILED             = "the TLS configuration for the engine endpoint could not be loaded"
+	ERR_REQUEST_CANCELLED             = "the request was cancelled"
+	ERR_CIRCUIT_OPEN                  = "the execution client is unreachable, so the request was not sent"
 )
 
 type MaybeRetryable interface {
@@ -36,7 +75,15 @@ func (e *JsonRpcError) Error() string {
 	return fmt.Sprintf("jsonrpc error, code: %v. msg: %v.", e.Code, e.Message)
 }
 
-// We only consider errors on the other client's side to be retryable
+// Matches any JsonRpcError with the same code, so the sentinels above can be used with errors.Is
+func (e *JsonRpcError) Is(target error) bool {
+	t, ok := target.(*JsonRpcError)
+	return ok && t.Code == e.Code
+}
+
+// We only consider errors on the other client's side to be retryable. Every other error would be returned again
+// for the same request: an unknown payload has to be rebuilt, a request for an unsupported fork has to use another
+// version of the method, and the remaining errors indicate a bug in the request
 func (e *JsonRpcError) IsRetryable() bool {
 	return e.Code == CODE_INTERNAL_ERROR || e.Code == CODE_SERVER_ERROR
 }
@@ -50,6 +97,28 @@ func IsRetryable(e error) bool {
 	return false
 }
 
+// Indicates that the execution client, or something between it and Regent, answered a request with the
+// response to a different one
+type ResponseIdMismatchError struct {
+	Method   RpcMethod
+	Expected uint64
+	// Nil if the response had no id
+	Actual *uint64
+}
+
+func (e *ResponseIdMismatchError) Error() string {
+	actual := "none"
+	if e.Actual != nil {
+		actual = fmt.Sprint(*e.Actual)
+	}
+	return fmt.Sprintf("the response to %v request %d had id %v", e.Method, e.Expected, actual)
+}
+
+// A new request gets a new id, so the response can't be confused with this one again
+func (e *ResponseIdMismatchError) IsRetryable() bool {
+	return true
+}
+
 type NonProtocolRpcError struct {
 	inner error
 	msg   string
@@ -0,0 +1,39 @@
+package rpc
+
+// The version of the Engine API methods to use for a given payload
+type EngineVersion uint
+
+const (
+	ENGINE_V1 EngineVersion = 1 // Paris
+	ENGINE_V2 EngineVersion = 2 // Shanghai
+	ENGINE_V3 EngineVersion = 3 // Cancun
+)
+
+// Activation timestamps for each fork after Paris. A nil timestamp means the fork is never activated.
+type ForkSchedule struct {
+	ShanghaiTime *uint64
+	CancunTime   *uint64
+}
+
+// Returns the Engine API version which must be used for a payload with the given timestamp
+func (s *ForkSchedule) VersionAt(timestamp uint64) EngineVersion {
+	if s.CancunTime != nil && timestamp >= *s.CancunTime {
+		return ENGINE_V3
+	}
+	if s.ShanghaiTime != nil && timestamp >= *s.ShanghaiTime {
+		return ENGINE_V2
+	}
+	return ENGINE_V1
+}
+
+// Returns the Engine API version of the latest fork in the schedule. Each version of the Engine API
+// also accepts the structures of previous forks, so this version is safe to use when no timestamp is available.
+func (s *ForkSchedule) LatestVersion() EngineVersion {
+	if s.CancunTime != nil {
+		return ENGINE_V3
+	}
+	if s.ShanghaiTime != nil {
+		return ENGINE_V2
+	}
+	return ENGINE_V1
+}
@@ -17,11 +17,20 @@ type EthJwt struct {
 	issuedAt     time.Time
 	signedString string
 	secret       []byte
+	// The clock which decides when the token is refreshed, or nil to use the wall clock
+	clock utils.Clock
+}
+
+func (ethJwt *EthJwt) now() time.Time {
+	if ethJwt.clock == nil {
+		return utils.SystemClock.Now()
+	}
+	return ethJwt.clock.Now()
 }
 
 // Refreshes the jwt. This is done automatically, so the method is private
 func (ethJwt *EthJwt) refresh() error {
-	ethJwt.issuedAt = time.Now()
+	ethJwt.issuedAt = ethJwt.now()
 
 	// Per the ethereum spec, valid JWTs have two claims - issued at (iat), and client version (clv)
 	// The token must use HMAC-SHA256.
@@ -40,7 +49,7 @@ func (ethJwt *EthJwt) refresh() error {
 
 // Returns the signed token string for the jwt, refreshing the token if necessary
 func (token *EthJwt) TokenString() (string, error) {
-	if time.Since(token.issuedAt) > time.Second*55 {
+	if token.now().Sub(token.issuedAt) > time.Second*55 {
 		err := token.refresh()
 		if err != nil {
 			return "", fmt.Errorf("%s: %w", ERR_JWT_REFRESH_FAILED, err)
@@ -55,6 +64,11 @@ func FromSecret(secret []byte) *EthJwt {
 	}
 }
 
+// Makes the token expire according to the given clock rather than the wall clock. Nil restores the wall clock
+func (token *EthJwt) SetClock(clock utils.Clock) {
+	token.clock = clock
+}
+
 func FromSecretFile(filename string) (*EthJwt, error) {
 	rawSecret, err := ioutil.ReadFile(filename)
 	if err != nil {
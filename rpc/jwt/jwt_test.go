@@ -0,0 +1,52 @@
+package jwt
+
+import (
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var testSecret = make([]byte, 32)
+
+// Decodes the issued at claim of a signed token
+func issuedAt(t *testing.T, signed string) int64 {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(signed, claims, func(*jwt.Token) (interface{}, error) { return testSecret, nil })
+	if err != nil {
+		t.Fatalf("ParseWithClaims - expected %v, got %v", nil, err)
+	}
+	return int64(claims["iat"].(float64))
+}
+
+func TestTokenString_refreshesExpiredToken(t *testing.T) {
+	clock := test.NewFakeClock(time.Unix(1000, 0))
+	token := FromSecret(testSecret)
+	token.SetClock(clock)
+
+	first, err := token.TokenString()
+	if err != nil || issuedAt(t, first) != 1000 {
+		t.Fatalf("TokenString - expected a token issued at %v, got %v. err %v", 1000, first, err)
+	}
+	// The token is reused while it is fresh
+	clock.Advance(55 * time.Second)
+	if second, _ := token.TokenString(); second != first {
+		t.Fatalf("TokenString - expected %v to be reused, got %v", first, second)
+	}
+	clock.Advance(time.Second)
+	if third, _ := token.TokenString(); issuedAt(t, third) != 1056 {
+		t.Fatalf("TokenString - expected a token issued at %v, got %v", 1056, issuedAt(t, third))
+	}
+}
+
+func TestTokenString_zeroValueUsesWallClock(t *testing.T) {
+	token := &EthJwt{secret: testSecret}
+	signed, err := token.TokenString()
+	if err != nil {
+		t.Fatalf("TokenString - expected %v, got %v", nil, err)
+	}
+	if iat := issuedAt(t, signed); time.Since(time.Unix(iat, 0)) > time.Minute {
+		t.Fatalf("TokenString - expected a token issued now, got one issued at %v", iat)
+	}
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"regent/utils"
+	"time"
+)
+
+// How requests for an Engine API method are sent: how long each attempt may take, how long to wait between
+// attempts and which errors are worth another attempt
+type MethodPolicy struct {
+	// The time allowed for a single attempt
+	Timeout time.Duration
+	// The backoff between attempts. If nil, DefaultRetryStrategy is used
+	Backoff *BackoffConfig
+	// Whether an error is worth another attempt. If nil, IsRetryable is used
+	Retryable func(error) bool
+}
+
+// The retry strategy of the policy, whose elapsed time is measured on the given clock
+func (p MethodPolicy) retryStrategy(clock utils.Clock) RetryStrategy {
+	var strategy RetryStrategy
+	if p.Backoff == nil {
+		strategy = DefaultRetryStrategy()
+	} else {
+		strategy = NewExponentialBackoffStrategy(*p.Backoff)
+	}
+	if backoff, ok := strategy.(*ExponentialBackoffStrategy); ok {
+		backoff.start, backoff.now = clock.Now(), clock.Now
+	}
+	return strategy
+}
+
+func (p MethodPolicy) isRetryable(err error) bool {
+	if p.Retryable == nil {
+		return IsRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+// The policy of methods which have no entry in DefaultPolicies
+var DEFAULT_POLICY = MethodPolicy{Timeout: 8 * time.Second}
+
+// A payload is only worth fetching while there is time left in the slot to publish it, so getPayload gives up quickly
+var GET_PAYLOAD_POLICY = MethodPolicy{
+	Timeout: 1 * time.Second,
+	Backoff: &BackoffConfig{
+		InitialInterval: 25 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     100 * time.Millisecond,
+		MaxAttempts:     3,
+		MaxElapsedTime:  time.Second,
+	},
+}
+
+// Executing a payload can take a long time while the execution client is catching up, and sync has nothing else
+// to do in the meantime, so newPayload waits patiently. Block production bounds its own newPayload calls by the slot
+var NEW_PAYLOAD_POLICY = MethodPolicy{
+	Timeout: 30 * time.Second,
+	Backoff: &BackoffConfig{
+		InitialInterval: 500 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     8 * time.Second,
+		MaxElapsedTime:  5 * time.Minute,
+	},
+}
+
+// The policy of each method, unless overridden on the client with SetPolicy
+var DefaultPolicies = map[RpcMethod]MethodPolicy{
+	FORK_CHOICE_UPDATED:               DEFAULT_POLICY,
+	FORK_CHOICE_UPDATED_V2:            DEFAULT_POLICY,
+	FORK_CHOICE_UPDATED_V3:            DEFAULT_POLICY,
+	NEW_EXECUTION_PAYLOAD:             NEW_PAYLOAD_POLICY,
+	NEW_EXECUTION_PAYLOAD_V2:          NEW_PAYLOAD_POLICY,
+	NEW_EXECUTION_PAYLOAD_V3:          NEW_PAYLOAD_POLICY,
+	GET_EXECUTION_PAYLOAD:             GET_PAYLOAD_POLICY,
+	GET_EXECUTION_PAYLOAD_V2:          GET_PAYLOAD_POLICY,
+	GET_EXECUTION_PAYLOAD_V3:          GET_PAYLOAD_POLICY,
+	EXCHANGE_CAPABILITIES:             DEFAULT_POLICY,
+	EXCHANGE_TRANSITION_CONFIGURATION: DEFAULT_POLICY,
+}
+
+// Returns the policy used for the given method: the client's override if it has one, otherwise the default
+func (client *Client) Policy(method RpcMethod) MethodPolicy {
+	policy, ok := client.policies[method]
+	if !ok {
+		policy, ok = DefaultPolicies[method]
+	}
+	if !ok {
+		policy = DEFAULT_POLICY
+	}
+	if policy.Timeout <= 0 {
+		policy.Timeout = DEFAULT_POLICY.Timeout
+	}
+	return policy
+}
+
+// Overrides the policy of a method for this client
+func (client *Client) SetPolicy(method RpcMethod, policy MethodPolicy) {
+	if client.policies == nil {
+		client.policies = make(map[RpcMethod]MethodPolicy)
+	}
+	client.policies[method] = policy
+}
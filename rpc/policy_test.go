@@ -0,0 +1,104 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+)
+
+func TestPolicy_defaults(t *testing.T) {
+	client := NewClient("8545")
+	if policy := client.Policy(GET_EXECUTION_PAYLOAD_V3); policy.Timeout != GET_PAYLOAD_POLICY.Timeout {
+		t.Fatalf("Policy - expected a timeout of %v for getPayload, got %v", GET_PAYLOAD_POLICY.Timeout, policy.Timeout)
+	}
+	if policy := client.Policy(NEW_EXECUTION_PAYLOAD); policy.Backoff != NEW_PAYLOAD_POLICY.Backoff {
+		t.Fatalf("Policy - expected the newPayload backoff, got %+v", policy.Backoff)
+	}
+	if policy := client.Policy(GET_BLOCK_BY_NUMBER); policy.Timeout != DEFAULT_POLICY.Timeout || policy.Backoff != nil {
+		t.Fatalf("Policy - expected the default policy for an unlisted method, got %+v", policy)
+	}
+}
+
+func TestPolicy_override(t *testing.T) {
+	client := NewClient("8545")
+	client.SetPolicy(FORK_CHOICE_UPDATED, MethodPolicy{Backoff: &BackoffConfig{MaxAttempts: 1}})
+	policy := client.Policy(FORK_CHOICE_UPDATED)
+	if policy.Timeout != DEFAULT_POLICY.Timeout || policy.Backoff.MaxAttempts != 1 {
+		t.Fatalf("Policy - expected the override with the default timeout, got %+v", policy)
+	}
+	if other := client.Policy(FORK_CHOICE_UPDATED_V2); other.Backoff != nil {
+		t.Fatalf("Policy - expected other methods to keep their default, got %+v", other)
+	}
+}
+
+func TestUpdateForkChoice_usesPolicy(t *testing.T) {
+	requests := 0
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		resp.Write([]byte(`{"error": {"code": -32000, "message": "Server error"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	client := TestRpcClient
+	client.policies = nil
+
+	// A server error is retryable by default, but not under this policy
+	client.SetPolicy(FORK_CHOICE_UPDATED, MethodPolicy{
+		Backoff:   &BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 1, MaxInterval: time.Millisecond},
+		Retryable: func(error) bool { return false },
+	})
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); err == nil || requests != 1 {
+		t.Fatalf("UpdateForkChoice - expected a single attempt, got %v. err %v", requests, err)
+	}
+
+	requests = 0
+	client.SetPolicy(FORK_CHOICE_UPDATED, MethodPolicy{
+		Backoff: &BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 1, MaxInterval: time.Millisecond, MaxAttempts: 2},
+	})
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); err == nil || requests != 2 {
+		t.Fatalf("UpdateForkChoice - expected %v attempts, got %v. err %v", 2, requests, err)
+	}
+}
+
+func TestUpdateForkChoice_retriesOnClientClock(t *testing.T) {
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(`{"error": {"code": -32000, "message": "Server error"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+	client := TestRpcClient
+	client.policies = nil
+	clock := test.NewFakeClock(time.Unix(0, 0))
+	client.SetClock(clock)
+
+	// Waits of up to an hour take no time, and the elapsed time is measured on the fake clock
+	client.SetPolicy(FORK_CHOICE_UPDATED, MethodPolicy{
+		Backoff: &BackoffConfig{InitialInterval: time.Hour, Multiplier: 1, MaxInterval: time.Hour, MaxElapsedTime: 2 * time.Hour},
+	})
+	start := time.Now()
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); err == nil {
+		t.Fatalf("UpdateForkChoice - expected an error, got %v", err)
+	}
+	if len(clock.Sleeps()) == 0 || time.Since(start) > time.Second || clock.Now().Sub(time.Unix(0, 0)) > 2*time.Hour {
+		t.Fatalf("UpdateForkChoice - expected to wait on the fake clock for at most %v, waited %v", 2*time.Hour, clock.Sleeps())
+	}
+}
+
+func TestRetryStrategy_usesClock(t *testing.T) {
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy {
+		return NewExponentialBackoffStrategy(BackoffConfig{InitialInterval: time.Second, Multiplier: 1, MaxInterval: time.Second, MaxElapsedTime: time.Minute})
+	}
+	clock := test.NewFakeClock(time.Unix(0, 0))
+	retries := DEFAULT_POLICY.retryStrategy(clock)
+	if retries.Done() {
+		t.Fatalf("Done - expected %v, got %v", false, true)
+	}
+	// The default strategy gives up once its elapsed time has passed on the clock
+	clock.Advance(time.Minute)
+	if !retries.Done() {
+		t.Fatalf("Done - expected %v after %v, got %v", true, time.Minute, false)
+	}
+}
@@ -1,15 +1,17 @@
 package rpc
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"regent/utils"
+	"sync/atomic"
 	"time"
 
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
 	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
 	"github.com/ledgerwatch/log/v3"
 )
 
@@ -20,10 +22,16 @@ const GET_BLOCK_BY_NUMBER RpcMethod = "eth_getBlockByNumber"
 const FORK_CHOICE_UPDATED RpcMethod = "engine_forkchoiceUpdatedV1"
 const NEW_EXECUTION_PAYLOAD RpcMethod = "engine_newPayloadV1"
 const GET_EXECUTION_PAYLOAD RpcMethod = "engine_getPayloadV1"
+const FORK_CHOICE_UPDATED_V2 RpcMethod = "engine_forkchoiceUpdatedV2"
+const NEW_EXECUTION_PAYLOAD_V2 RpcMethod = "engine_newPayloadV2"
+const GET_EXECUTION_PAYLOAD_V2 RpcMethod = "engine_getPayloadV2"
+const FORK_CHOICE_UPDATED_V3 RpcMethod = "engine_forkchoiceUpdatedV3"
+const NEW_EXECUTION_PAYLOAD_V3 RpcMethod = "engine_newPayloadV3"
+const GET_EXECUTION_PAYLOAD_V3 RpcMethod = "engine_getPayloadV3"
 
 // Defines a strategy for retrying a fallible operation like an RPC request
-// After each failed attempt, the caller will call `Next` and sleep for the specified duration
-// until a call to `Done` returns true, at which point the caller will exit.
+// After each failed attempt, the caller will call `Done`. If it returns false, the caller will call `Next`, sleep
+// for the specified duration and try again. Otherwise, the caller gives up.
 type RetryStrategy interface {
 	Next() time.Duration
 	Done() bool
@@ -59,7 +67,7 @@ func (s *SimpleRetryStrategy) Next() time.Duration {
 }
 
 func (s *SimpleRetryStrategy) Done() bool {
-	return s.attempt >= 5
+	return s.attempt >= 5*time.Second
 }
 
 type PayloadStatusString string
@@ -68,6 +76,11 @@ const (
 	VALID_PAYLOAD   PayloadStatusString = "VALID"
 	INVALID_PAYLOAD PayloadStatusString = "INVALID"
 	SYNCING_PAYLOAD PayloadStatusString = "SYNCING"
+	// Only returned by engine_newPayload. The block hash is correct, but the payload was not validated, e.g. because
+	// it is not on the canonical chain or the execution client doesn't have its ancestors yet
+	ACCEPTED_PAYLOAD PayloadStatusString = "ACCEPTED"
+	// Only returned by engine_newPayload. The block hash does not match the contents of the payload
+	INVALID_BLOCK_HASH_PAYLOAD PayloadStatusString = "INVALID_BLOCK_HASH"
 )
 
 type PayloadStatus struct {
@@ -81,20 +94,124 @@ type ForkChoiceUpdatedResult struct {
 	PayloadId     string         `json:"payloadId"`
 }
 
+// A withdrawal of funds from the consensus layer into the execution layer, introduced in Shanghai (EIP-4895)
+type Withdrawal struct {
+	Index          hexutil.Uint64 `json:"index"`
+	ValidatorIndex hexutil.Uint64 `json:"validatorIndex"`
+	Address        common.Address `json:"address"`
+	Amount         hexutil.Uint64 `json:"amount"`
+}
+
+// An execution payload with the list of withdrawals added in Shanghai.
+// When sent with a V1 method, only the embedded V1 payload is serialized
+type ExecutionPayloadV2 struct {
+	commands.ExecutionPayload
+	Withdrawals []*Withdrawal `json:"withdrawals"`
+}
+
+// Payload attributes with the list of withdrawals added in Shanghai.
+// When sent with a V1 method, only the embedded V1 attributes are serialized
+type PayloadAttributesV2 struct {
+	commands.PayloadAttributes
+	Withdrawals []*Withdrawal `json:"withdrawals"`
+}
+
+// Returns a copy of the payload whose withdrawals are an empty list rather than nil,
+// since V2+ methods require the field to be present
+func (p *ExecutionPayloadV2) withWithdrawals() *ExecutionPayloadV2 {
+	payload := *p
+	if payload.Withdrawals == nil {
+		payload.Withdrawals = make([]*Withdrawal, 0)
+	}
+	return &payload
+}
+
+// Returns a copy of the attributes whose withdrawals are an empty list rather than nil,
+// since V2+ methods require the field to be present
+func (a *PayloadAttributesV2) withWithdrawals() *PayloadAttributesV2 {
+	attributes := *a
+	if attributes.Withdrawals == nil {
+		attributes.Withdrawals = make([]*Withdrawal, 0)
+	}
+	return &attributes
+}
+
+// An execution payload with the blob gas fields added in Cancun (EIP-4844).
+// When sent with a V1 or V2 method, only the embedded payload of that version is serialized
+type ExecutionPayloadV3 struct {
+	ExecutionPayloadV2
+	BlobGasUsed   hexutil.Uint64 `json:"blobGasUsed"`
+	ExcessBlobGas hexutil.Uint64 `json:"excessBlobGas"`
+}
+
+// Payload attributes with the parent beacon block root added in Cancun (EIP-4788).
+// When sent with a V1 or V2 method, only the embedded attributes of that version are serialized
+type PayloadAttributesV3 struct {
+	PayloadAttributesV2
+	ParentBeaconBlockRoot common.Hash `json:"parentBeaconBlockRoot"`
+}
+
+// The blobs included in a payload, along with their KZG commitments and proofs
+type BlobsBundle struct {
+	Commitments []hexutil.Bytes `json:"commitments"`
+	Proofs      []hexutil.Bytes `json:"proofs"`
+	Blobs       []hexutil.Bytes `json:"blobs"`
+}
+
+// The version byte prepended to the hash of a KZG commitment (EIP-4844)
+const VERSIONED_HASH_VERSION_KZG byte = 0x01
+
+// Computes the versioned hash of a KZG commitment, as expected by engine_newPayloadV3
+func KzgToVersionedHash(commitment []byte) common.Hash {
+	hash := common.Hash(sha256.Sum256(commitment))
+	hash[0] = VERSIONED_HASH_VERSION_KZG
+	return hash
+}
+
+// Returns the versioned hashes of the commitments in the bundle. A nil bundle has no versioned hashes.
+func (b *BlobsBundle) VersionedHashes() []common.Hash {
+	hashes := make([]common.Hash, 0)
+	if b == nil {
+		return hashes
+	}
+	for _, commitment := range b.Commitments {
+		hashes = append(hashes, KzgToVersionedHash(commitment))
+	}
+	return hashes
+}
+
+// The result of engine_getPayloadV2 and engine_getPayloadV3. V1 responses are wrapped in this type with a nil BlockValue,
+// and V1 and V2 responses have a nil BlobsBundle
+type GetPayloadResult struct {
+	ExecutionPayload *ExecutionPayloadV3 `json:"executionPayload"`
+	// The expected value to be received by the fee recipient, in wei
+	BlockValue            *hexutil.Big `json:"blockValue"`
+	BlobsBundle           *BlobsBundle `json:"blobsBundle"`
+	ShouldOverrideBuilder bool         `json:"shouldOverrideBuilder"`
+}
+
 // An Ethereum Json-rpc message
 type Request struct {
 	JsonRPC string        `json:"jsonrpc"`
 	Method  RpcMethod     `json:"method"`
 	Params  []interface{} `json:"params"`
-	Id      uint          `json:"id"`
+	Id      uint64        `json:"id"`
 }
 
 // An Ethereum Json-rpc response
 type Response[R comparable] struct {
-	JsonRPC string        `json:"jsonrpc"`
-	Result  R             `json:"result"`
-	Id      uint          `json:"id"`
-	Error   *JsonRpcError `json:"error"`
+	JsonRPC string `json:"jsonrpc"`
+	Result  R      `json:"result"`
+	// Nil if the server couldn't read the id of the request
+	Id    *uint64       `json:"id"`
+	Error *JsonRpcError `json:"error"`
+}
+
+// The id of the most recent request. Ids are unique within the process, so a response can always be matched with its request
+var lastRequestId uint64
+
+func nextRequestId() uint64 {
+	return atomic.AddUint64(&lastRequestId, 1)
 }
 
 // Creates a Json-rpc message with the supplied method and parameters
@@ -106,78 +223,104 @@ func NewRequest(method RpcMethod, params ...interface{}) *Request {
 		JsonRPC: "2.0",
 		Method:  method,
 		Params:  params,
-		Id:      1,
+		Id:      nextRequestId(),
 	}
 }
 
-// Gets a response of type R by using `client` to send the provided `request` with the given timeout and retry strategy
+// Gets a response of type R by using `client` to send the provided `request` with the timeout, retry strategy and
+// retryable errors of the given policy. The timeout applies to each attempt. If ctx is cancelled, the request and any
+// pending retry are abandoned
 // This is a function rather than a method of client to workaround this limitation of Go's generics:
 // https://go.googlesource.com/proposal/+/refs/heads/master/design/43651-type-parameters.md#No-parameterized-methods
-func getResponse[R comparable](client *Client, request *Request, timeout time.Duration, retries RetryStrategy) (R, error) {
-	var err error
-	for done := false; !done; done = retries.Done() {
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
-		defer cancel()
-
-		var ret R
-		ret, err = sendRequest[R](ctx, client, request)
-		if err != nil {
-			log.Warn("Error sending msg to execution client", "err", err)
-			if IsRetryable(err) {
-				time.Sleep(retries.Next())
-				continue
-			}
+func getResponse[R comparable](ctx context.Context, client *Client, request *Request, policy MethodPolicy) (R, error) {
+	retries := policy.retryStrategy(client.Clock())
+	for attempt := 0; ; attempt++ {
+		// A late response to an earlier attempt must not be mistaken for a response to this one
+		if attempt > 0 {
+			request.Id = nextRequestId()
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, policy.Timeout)
+		ret, err := sendRequest[R](attemptCtx, client, request)
+		cancel()
+		// The transport reports a cancelled request as a failure to send or read it, which would otherwise be retried
+		if err != nil && ctx.Err() != nil {
+			return *new(R), ErrFrom(ERR_REQUEST_CANCELLED, ctx.Err())
+		}
+		if err == nil {
+			return ret, nil
 		}
-		return ret, err
+		log.Warn("Error sending msg to execution client", "err", err)
+		if !policy.isRetryable(err) || retries.Done() {
+			return ret, err
+		}
+		if err := Sleep(ctx, client.Clock(), retries.Next()); err != nil {
+			return *new(R), err
+		}
+	}
+}
+
+// Waits for the given duration on the given clock, unless ctx is cancelled first.
+// Returns an error matching both ERR_REQUEST_CANCELLED and ctx.Err() if it was
+func Sleep(ctx context.Context, clock utils.Clock, d time.Duration) error {
+	if err := clock.Sleep(ctx, d); err != nil {
+		return ErrFrom(ERR_REQUEST_CANCELLED, err)
 	}
-	return *new(R), err
+	return nil
 }
 
 // Sends a JSON-RPC method whose response is unmarshalled into a Response with Result type R.
 // This allows the caller to specify the type for the response.Result at compile time, rather than
 // relying on runtime reflection to identify it
 func sendRequest[R comparable](ctx context.Context, client *Client, msg *Request) (R, error) {
-	marshalled, err := json.Marshal(msg)
+	body, err := client.send(ctx, msg)
 	if err != nil {
-		err = ErrFrom(ERR_MARSHALLING_FAILED, err)
-		log.Crit(err.Error())
 		return *new(R), err
 	}
-	log.Trace("sending message", "msg", string(marshalled))
-	req, err := http.NewRequest("POST", client.Endpoint, bytes.NewBuffer(marshalled))
+	response := Response[R]{}
+	err = json.Unmarshal(body, &response)
 	if err != nil {
-		err = ErrFrom(ERR_REQUEST_CREATION_FAILED, err)
-		log.Crit(err.Error())
+		return *new(R), ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("Error unmarshalling response to msg %v. response body %v. err %w", msg, string(body), err))
+	}
+	// Errors about requests which the server couldn't parse have a null id
+	if response.Error != nil && response.Id == nil {
+		return *new(R), response.Error
+	}
+	if response.Id == nil || *response.Id != msg.Id {
+		err = &ResponseIdMismatchError{Method: msg.Method, Expected: msg.Id, Actual: response.Id}
+		log.Error("Discarding a response to a different request", "err", err)
 		return *new(R), err
 	}
-
-	req.Header["Content-Type"] = []string{"application/json"}
-	if client.authToken != nil {
-		tokenString, err := client.authToken.TokenString()
-		if err != nil {
-			return *new(R), ErrFrom(ERR_TOKEN_STRING_RETRIEVAL_FAILED, err)
-		}
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", tokenString))
+	if response.Error == nil && response.Result == *new(R) {
+		return response.Result, ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("The response to msg %v did not contain a value of type %T. response body %v. err %w", msg, response.Result, string(body), err))
+	}
+	if response.Error != nil {
+		return response.Result, response.Error
 	}
+	return response.Result, nil
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// Marshals the message, which is either a request or a batch of them, and sends it over the client's transport.
+// Returns the raw response
+func (client *Client) send(ctx context.Context, msg interface{}) ([]byte, error) {
+	marshalled, err := json.Marshal(msg)
 	if err != nil {
-		return *new(R), ErrFrom(ERR_REQUEST_SEND_FAILED, err)
+		err = ErrFrom(ERR_MARSHALLING_FAILED, err)
+		log.Crit(err.Error())
+		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return *new(R), ErrFrom(ERR_RESPONSE_READ_FAILED, fmt.Errorf("Error reading response to msg %v. %w", msg, err))
+	log.Trace("sending message", "msg", string(marshalled))
+	var tokenString string
+	if client.authToken != nil {
+		tokenString, err = client.authToken.TokenString()
+		if err != nil {
+			return nil, ErrFrom(ERR_TOKEN_STRING_RETRIEVAL_FAILED, err)
+		}
 	}
-	response := Response[R]{}
-	err = json.Unmarshal(body, &response)
+	generation, err := client.breaker.allow()
 	if err != nil {
-		return *new(R), ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("Error unmarshalling response to msg %v. response body %v. err %w", msg, string(body), err))
+		return nil, err
 	}
-	if response.Error != nil {
-		return response.Result, response.Error
-	}
-	if response.Result == *new(R) {
-		return response.Result, ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("The response to msg %v did not contain a value of type %T. response body %v. err %w", msg, response.Result, string(body), err))
-	}
-	return response.Result, nil
+	body, err := client.transport.Send(ctx, marshalled, tokenString)
+	client.breaker.record(generation, err)
+	return body, err
 }
@@ -1,33 +1,66 @@
 package rpc
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"regent/utils/test"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
 )
 
 var TestRpcClient = NewClientWithJwt("8545", make([]byte, 32))
 
 func init() {
-	TestRpcClient.Endpoint = test.TestServer.URL
+	TestRpcClient.SetEndpoint(test.TestServer.URL)
+	// Most tests answer with canned responses. Tests of response ids turn this off with withoutEchoedIds
+	test.TestHandler.SetEchoIds(true)
+}
+
+// Makes the test handler send responses with exactly the id they were written with. Returns a function which restores
+// the echoed ids
+func withoutEchoedIds() func() {
+	test.TestHandler.SetEchoIds(false)
+	return func() { test.TestHandler.SetEchoIds(true) }
+}
+
+// Activates Shanghai on the test client at the given timestamp. Returns a function which restores the previous schedule
+func activateShanghai(timestamp uint64) func() {
+	previousForks := TestRpcClient.Forks
+	TestRpcClient.Forks = ForkSchedule{ShanghaiTime: &timestamp}
+	return func() { TestRpcClient.Forks = previousForks }
+}
+
+// Activates Shanghai at genesis and Cancun at the given timestamp. Returns a function which restores the previous schedule
+func activateCancun(timestamp uint64) func() {
+	previousForks := TestRpcClient.Forks
+	shanghaiTime := uint64(0)
+	TestRpcClient.Forks = ForkSchedule{ShanghaiTime: &shanghaiTime, CancunTime: &timestamp}
+	return func() { TestRpcClient.Forks = previousForks }
 }
 
 func TestUpdateForkChoice_emptyResponse(t *testing.T) {
-	test.TestHandler.Response = make([]byte, 0)
-	_, err := TestRpcClient.UpdateForkChoice(&commands.ForkChoiceState{})
+	test.TestHandler.SetResponse(make([]byte, 0))
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
 	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
 		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
 	}
 }
 
 func TestUpdateForkChoice_wrongResponseMessage(t *testing.T) {
-	// Return request message instead of response
-	test.TestHandler.Response = []byte(`{"jsonrpc":"2.0","method":"engine_forkchoiceUpdatedV1","params":[{"headBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000","safeBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000","finalizedBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000"}],"id":1}`)
-	_, err := TestRpcClient.UpdateForkChoice(&commands.ForkChoiceState{})
+	// Return request message instead of response. The mock handler gives it the id of the request, as an echo would
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc":"2.0","method":"engine_forkchoiceUpdatedV1","params":[{"headBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000","safeBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000","finalizedBlockHash":"0x0000000000000000000000000000000000000000000000000000000000000000"}]}`))
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
 	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
 		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
 	}
@@ -37,12 +70,12 @@ func TestUpdateForkChoice_invalidEndpoint(t *testing.T) {
 	// Disable retries and override the handler function
 	previousRetryStrategy := DefaultRetryStrategy
 	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
-	TestRpcClient.Endpoint = "not-a-url"
+	TestRpcClient.SetEndpoint("not-a-url")
 	defer func() {
 		DefaultRetryStrategy = previousRetryStrategy
-		TestRpcClient.Endpoint = test.TestServer.URL
+		TestRpcClient.SetEndpoint(test.TestServer.URL)
 	}()
-	_, err := TestRpcClient.UpdateForkChoice(&commands.ForkChoiceState{})
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
 	if !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
 		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
 	}
@@ -52,16 +85,16 @@ func TestUpdateForkChoice_unexpectedEOF(t *testing.T) {
 	// Disable retries and override the handler function
 	previousRetryStrategy := DefaultRetryStrategy
 	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
-	test.TestHandler.HandlerFunc = func(resp http.ResponseWriter, req *http.Request) {
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
 		test.TestServer.CloseClientConnections()
-	}
+	})
 	// Restore state after the test ends
 	defer func() {
 		DefaultRetryStrategy = previousRetryStrategy
-		test.TestHandler.HandlerFunc = nil
+		test.TestHandler.SetHandlerFunc(nil)
 	}()
 
-	_, err := TestRpcClient.UpdateForkChoice(&commands.ForkChoiceState{})
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
 	if !test.ErrorIs(err, ERR_RESPONSE_READ_FAILED) {
 		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_RESPONSE_READ_FAILED, err)
 	}
@@ -84,8 +117,8 @@ func TestInfiniteRetryStrategy_isLinearWithCap(t *testing.T) {
 
 func TestUpdateForkChoice_success(t *testing.T) {
 	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.UpdateForkChoice(&commands.ForkChoiceState{})
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
 	if err != nil {
 		t.Fatalf("UpdateForkChoice - expected %v, got %v", nil, err)
 	}
@@ -93,8 +126,8 @@ func TestUpdateForkChoice_success(t *testing.T) {
 
 func TestUpdateForkChoiceAndBuildBlock_success(t *testing.T) {
 	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(&commands.ForkChoiceState{}, &commands.PayloadAttributes{})
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, &PayloadAttributesV3{})
 	if err != nil {
 		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected %v, got %v", nil, err)
 	}
@@ -102,26 +135,28 @@ func TestUpdateForkChoiceAndBuildBlock_success(t *testing.T) {
 
 func TestUpdateForkChoiceAndBuildBlock_invalidResponse(t *testing.T) {
 	resp, _ := json.Marshal(Response[*commands.ExecutionPayload]{})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(&commands.ForkChoiceState{}, &commands.PayloadAttributes{})
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, &PayloadAttributesV3{})
 	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
 		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
 	}
 }
 
 func TestSendExecutionPayload_success(t *testing.T) {
-	resp, _ := json.Marshal(Response[commands.PayloadAttributes]{})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.SendExecutionPayload(&commands.ExecutionPayload{})
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "result": {"status": "INVALID", "latestValidHash": "0x0000000000000000000000000000000000000000000000000000000000000001", "validationError": "bad state root"}}`))
+	status, err := TestRpcClient.SendExecutionPayload(context.Background(), &ExecutionPayloadV3{}, nil, common.Hash{})
 	if err != nil {
 		t.Fatalf("SendExecutionPayload - expected %v, got %v", nil, err)
 	}
+	if status.Status != INVALID_PAYLOAD || *status.LatestValidHash != common.HexToHash("0x01") || *status.ValidationError != "bad state root" {
+		t.Fatalf("SendExecutionPayload - expected the payload status, got %+v", status)
+	}
 }
 
 func TestSendExecutionPayload_invalidResponse(t *testing.T) {
 	resp, _ := json.Marshal(Response[*commands.ExecutionPayload]{})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.SendExecutionPayload(&commands.ExecutionPayload{})
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.SendExecutionPayload(context.Background(), &ExecutionPayloadV3{}, nil, common.Hash{})
 	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
 		t.Fatalf("SendExecutionPayload - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
 	}
@@ -131,8 +166,8 @@ func TestGetPayload_success(t *testing.T) {
 	resp, _ := json.Marshal(Response[*commands.ExecutionPayload]{
 		Result: new(commands.ExecutionPayload),
 	})
-	test.TestHandler.Response = []byte(resp)
-	_, err := TestRpcClient.GetPayload("0x0000000000000000")
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
 	if err != nil {
 		t.Fatalf("GetPayload - expected %v, got %v", nil, err)
 	}
@@ -140,10 +175,512 @@ func TestGetPayload_success(t *testing.T) {
 
 func TestGetPayload_invalidResponse(t *testing.T) {
 	resp, _ := json.Marshal(Response[int]{})
-	test.TestHandler.Response = []byte(resp)
-	result, err := TestRpcClient.GetPayload("0x0000000000000000")
+	test.TestHandler.SetResponse([]byte(resp))
+	result, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
 	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
 		t.Error("result: ", result)
 		t.Fatalf("GetPayload - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
 	}
 }
+
+func TestForkSchedule_versionAt(t *testing.T) {
+	shanghaiTime := uint64(100)
+	s := ForkSchedule{}
+	if v := s.VersionAt(200); v != ENGINE_V1 || s.LatestVersion() != ENGINE_V1 {
+		t.Fatalf("VersionAt - expected %v, got %v", ENGINE_V1, v)
+	}
+	s.ShanghaiTime = &shanghaiTime
+	if v := s.VersionAt(99); v != ENGINE_V1 {
+		t.Fatalf("VersionAt - expected %v, got %v", ENGINE_V1, v)
+	}
+	if v := s.VersionAt(100); v != ENGINE_V2 || s.LatestVersion() != ENGINE_V2 {
+		t.Fatalf("VersionAt - expected %v, got %v", ENGINE_V2, v)
+	}
+}
+
+func TestUpdateForkChoice_v2(t *testing.T) {
+	defer activateShanghai(0)()
+	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
+	test.TestHandler.SetResponse([]byte(resp))
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if err != nil {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", nil, err)
+	}
+	if method := test.TestHandler.LastMethod(); method != string(FORK_CHOICE_UPDATED_V2) {
+		t.Fatalf("UpdateForkChoice - expected method %v, got %v", FORK_CHOICE_UPDATED_V2, method)
+	}
+}
+
+func TestUpdateForkChoiceAndBuildBlock_versionFollowsTimestamp(t *testing.T) {
+	defer activateShanghai(100)()
+	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
+	test.TestHandler.SetResponse([]byte(resp))
+
+	// V2 methods accept V1 attributes, so pre-Shanghai attributes are sent with the highest supported version
+	attributes := &PayloadAttributesV3{}
+	attributes.Timestamp = 99
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, attributes)
+	if err != nil || test.TestHandler.LastMethod() != string(FORK_CHOICE_UPDATED_V2) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected method %v, got %v. err %v", FORK_CHOICE_UPDATED_V2, test.TestHandler.LastMethod(), err)
+	}
+	if bytes.Contains(test.TestHandler.LastRequest(), []byte("withdrawals")) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - V1 attributes contained withdrawals: %s", test.TestHandler.LastRequest())
+	}
+
+	attributes.Timestamp = 100
+	_, err = TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, attributes)
+	if err != nil || test.TestHandler.LastMethod() != string(FORK_CHOICE_UPDATED_V2) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected method %v, got %v. err %v", FORK_CHOICE_UPDATED_V2, test.TestHandler.LastMethod(), err)
+	}
+	if !bytes.Contains(test.TestHandler.LastRequest(), []byte(`"withdrawals":[]`)) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - V2 request did not contain withdrawals: %s", test.TestHandler.LastRequest())
+	}
+}
+
+func TestSendExecutionPayload_v2(t *testing.T) {
+	defer activateShanghai(0)()
+	resp, _ := json.Marshal(Response[*PayloadStatus]{Result: &PayloadStatus{Status: VALID_PAYLOAD}})
+	test.TestHandler.SetResponse([]byte(resp))
+	payload := &ExecutionPayloadV3{}
+	payload.Withdrawals = []*Withdrawal{{Index: 1, Amount: 10}}
+	_, err := TestRpcClient.SendExecutionPayload(context.Background(), payload, nil, common.Hash{})
+	if err != nil {
+		t.Fatalf("SendExecutionPayload - expected %v, got %v", nil, err)
+	}
+	if method := test.TestHandler.LastMethod(); method != string(NEW_EXECUTION_PAYLOAD_V2) {
+		t.Fatalf("SendExecutionPayload - expected method %v, got %v", NEW_EXECUTION_PAYLOAD_V2, method)
+	}
+	if !bytes.Contains(test.TestHandler.LastRequest(), []byte(`"withdrawals":[{"index":"0x1"`)) || bytes.Contains(test.TestHandler.LastRequest(), []byte("blobGasUsed")) {
+		t.Fatalf("SendExecutionPayload - request was not a V2 payload: %s", test.TestHandler.LastRequest())
+	}
+}
+
+func TestGetPayload_v2(t *testing.T) {
+	defer activateShanghai(0)()
+	test.TestHandler.SetResponse([]byte(`{"result": {"executionPayload": {"blockNumber": "0x2", "withdrawals": [{"index": "0x1", "validatorIndex": "0x2", "address": "0x013068165fe8257f960c6831745927f924b2dd0d", "amount": "0x3"}]}, "blockValue": "0x10"}}`))
+	result, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
+	if err != nil {
+		t.Fatalf("GetPayload - expected %v, got %v", nil, err)
+	}
+	if method := test.TestHandler.LastMethod(); method != string(GET_EXECUTION_PAYLOAD_V2) {
+		t.Fatalf("GetPayload - expected method %v, got %v", GET_EXECUTION_PAYLOAD_V2, method)
+	}
+	if result.BlockValue == nil || result.BlockValue.ToInt().Int64() != 16 {
+		t.Fatalf("GetPayload - expected block value %v, got %v", 16, result.BlockValue)
+	}
+	if result.ExecutionPayload.BlockNumber != 2 || len(result.ExecutionPayload.Withdrawals) != 1 || result.ExecutionPayload.Withdrawals[0].Amount != 3 {
+		t.Fatalf("GetPayload - unexpected payload %+v", result.ExecutionPayload)
+	}
+}
+
+func TestGetPayload_v2MissingPayload(t *testing.T) {
+	defer activateShanghai(0)()
+	test.TestHandler.SetResponse([]byte(`{"result": {"executionPayload": null, "blockValue": "0x10"}}`))
+	_, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
+	if !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
+		t.Fatalf("GetPayload - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
+	}
+}
+
+func TestGetPayload_v1HasNoBlockValue(t *testing.T) {
+	resp, _ := json.Marshal(Response[*commands.ExecutionPayload]{
+		Result: &commands.ExecutionPayload{BlockNumber: 2},
+	})
+	test.TestHandler.SetResponse([]byte(resp))
+	result, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
+	if err != nil || test.TestHandler.LastMethod() != string(GET_EXECUTION_PAYLOAD) {
+		t.Fatalf("GetPayload - expected method %v, got %v. err %v", GET_EXECUTION_PAYLOAD, test.TestHandler.LastMethod(), err)
+	}
+	if result.BlockValue != nil || result.ExecutionPayload.BlockNumber != 2 {
+		t.Fatalf("GetPayload - unexpected result %+v", result)
+	}
+}
+
+func TestForkSchedule_versionAtCancun(t *testing.T) {
+	shanghaiTime, cancunTime := uint64(100), uint64(200)
+	s := ForkSchedule{ShanghaiTime: &shanghaiTime, CancunTime: &cancunTime}
+	if v := s.VersionAt(199); v != ENGINE_V2 {
+		t.Fatalf("VersionAt - expected %v, got %v", ENGINE_V2, v)
+	}
+	if v := s.VersionAt(200); v != ENGINE_V3 || s.LatestVersion() != ENGINE_V3 {
+		t.Fatalf("VersionAt - expected %v, got %v", ENGINE_V3, v)
+	}
+}
+
+func TestUpdateForkChoiceAndBuildBlock_v3(t *testing.T) {
+	defer activateCancun(0)()
+	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
+	test.TestHandler.SetResponse([]byte(resp))
+
+	attributes := &PayloadAttributesV3{ParentBeaconBlockRoot: common.HexToHash("0x01")}
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, attributes)
+	if err != nil || test.TestHandler.LastMethod() != string(FORK_CHOICE_UPDATED_V3) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected method %v, got %v. err %v", FORK_CHOICE_UPDATED_V3, test.TestHandler.LastMethod(), err)
+	}
+	expected := fmt.Sprintf(`"withdrawals":[],"parentBeaconBlockRoot":"%v"`, common.HexToHash("0x01").Hex())
+	if !bytes.Contains(test.TestHandler.LastRequest(), []byte(expected)) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - V3 request did not contain %s: %s", expected, test.TestHandler.LastRequest())
+	}
+}
+
+func TestSendExecutionPayload_v3(t *testing.T) {
+	defer activateCancun(0)()
+	resp, _ := json.Marshal(Response[*PayloadStatus]{Result: &PayloadStatus{Status: VALID_PAYLOAD}})
+	test.TestHandler.SetResponse([]byte(resp))
+
+	payload := &ExecutionPayloadV3{BlobGasUsed: 0x20000, ExcessBlobGas: 1}
+	bundle := &BlobsBundle{Commitments: []hexutil.Bytes{{0xaa}}}
+	_, err := TestRpcClient.SendExecutionPayload(context.Background(), payload, bundle.VersionedHashes(), common.HexToHash("0x02"))
+	if err != nil || test.TestHandler.LastMethod() != string(NEW_EXECUTION_PAYLOAD_V3) {
+		t.Fatalf("SendExecutionPayload - expected method %v, got %v. err %v", NEW_EXECUTION_PAYLOAD_V3, test.TestHandler.LastMethod(), err)
+	}
+	var msg struct {
+		Params []json.RawMessage `json:"params"`
+	}
+	json.Unmarshal(test.TestHandler.LastRequest(), &msg)
+	if len(msg.Params) != 3 {
+		t.Fatalf("SendExecutionPayload - expected 3 params, got %s", test.TestHandler.LastRequest())
+	}
+	if !bytes.Contains(msg.Params[0], []byte(`"blobGasUsed":"0x20000","excessBlobGas":"0x1"`)) {
+		t.Fatalf("SendExecutionPayload - payload did not contain blob gas fields: %s", msg.Params[0])
+	}
+	var hashes []common.Hash
+	json.Unmarshal(msg.Params[1], &hashes)
+	if len(hashes) != 1 || hashes[0] != KzgToVersionedHash([]byte{0xaa}) {
+		t.Fatalf("SendExecutionPayload - unexpected versioned hashes: %s", msg.Params[1])
+	}
+	if string(msg.Params[2]) != fmt.Sprintf(`"%v"`, common.HexToHash("0x02").Hex()) {
+		t.Fatalf("SendExecutionPayload - unexpected parent beacon block root: %s", msg.Params[2])
+	}
+}
+
+func TestSendExecutionPayload_v3NoBlobs(t *testing.T) {
+	defer activateCancun(0)()
+	resp, _ := json.Marshal(Response[*PayloadStatus]{Result: &PayloadStatus{Status: VALID_PAYLOAD}})
+	test.TestHandler.SetResponse([]byte(resp))
+
+	_, err := TestRpcClient.SendExecutionPayload(context.Background(), &ExecutionPayloadV3{}, nil, common.Hash{})
+	if err != nil {
+		t.Fatalf("SendExecutionPayload - expected %v, got %v", nil, err)
+	}
+	if !bytes.Contains(test.TestHandler.LastRequest(), []byte(`,[],"0x0000000000000000000000000000000000000000000000000000000000000000"]`)) {
+		t.Fatalf("SendExecutionPayload - expected an empty list of versioned hashes: %s", test.TestHandler.LastRequest())
+	}
+}
+
+func TestGetPayload_v3(t *testing.T) {
+	defer activateCancun(0)()
+	test.TestHandler.SetResponse([]byte(`{"result": {"executionPayload": {"blockNumber": "0x2", "withdrawals": [], "blobGasUsed": "0x20000", "excessBlobGas": "0x0"}, "blockValue": "0x10", "blobsBundle": {"commitments": ["0xaa"], "proofs": ["0xbb"], "blobs": ["0xcc"]}, "shouldOverrideBuilder": true}}`))
+	result, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
+	if err != nil || test.TestHandler.LastMethod() != string(GET_EXECUTION_PAYLOAD_V3) {
+		t.Fatalf("GetPayload - expected method %v, got %v. err %v", GET_EXECUTION_PAYLOAD_V3, test.TestHandler.LastMethod(), err)
+	}
+	if result.ExecutionPayload.BlobGasUsed != 0x20000 || !result.ShouldOverrideBuilder {
+		t.Fatalf("GetPayload - unexpected result %+v", result)
+	}
+	if result.BlobsBundle == nil || len(result.BlobsBundle.Blobs) != 1 || result.BlobsBundle.VersionedHashes()[0] != KzgToVersionedHash([]byte{0xaa}) {
+		t.Fatalf("GetPayload - unexpected blobs bundle %+v", result.BlobsBundle)
+	}
+}
+
+func TestKzgToVersionedHash(t *testing.T) {
+	// sha256("") = e3b0c442...
+	hash := KzgToVersionedHash([]byte{})
+	if hash != common.HexToHash("0x01b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
+		t.Fatalf("KzgToVersionedHash - unexpected hash %v", hash)
+	}
+	if hashes := (*BlobsBundle)(nil).VersionedHashes(); hashes == nil || len(hashes) != 0 {
+		t.Fatalf("VersionedHashes - expected an empty list, got %v", hashes)
+	}
+}
+
+// Sets the capabilities of the test client. Returns a function which restores the un-negotiated state
+func setCapabilities(methods ...RpcMethod) func() {
+	TestRpcClient.SetCapabilities(methods)
+	return func() { TestRpcClient.SetCapabilities(nil) }
+}
+
+func TestUpdateForkChoiceAndBuildBlock_prefersHighestSupportedVersion(t *testing.T) {
+	defer activateShanghai(100)()
+	defer setCapabilities(FORK_CHOICE_UPDATED)()
+	resp, _ := json.Marshal(Response[ForkChoiceUpdatedResult]{})
+	test.TestHandler.SetResponse([]byte(resp))
+
+	attributes := &PayloadAttributesV3{}
+	attributes.Timestamp = 99
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, attributes)
+	if err != nil || test.TestHandler.LastMethod() != string(FORK_CHOICE_UPDATED) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected method %v, got %v. err %v", FORK_CHOICE_UPDATED, test.TestHandler.LastMethod(), err)
+	}
+}
+
+func TestUpdateForkChoiceAndBuildBlock_noCompatibleMethod(t *testing.T) {
+	defer activateShanghai(0)()
+	defer setCapabilities(FORK_CHOICE_UPDATED, FORK_CHOICE_UPDATED_V3)()
+	test.TestHandler.ClearLastRequest()
+
+	_, err := TestRpcClient.UpdateForkChoiceAndBuildBlock(context.Background(), &commands.ForkChoiceState{}, &PayloadAttributesV3{})
+	if !test.ErrorIs(err, ERR_NO_COMPATIBLE_METHOD) {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected %v, got %v", ERR_NO_COMPATIBLE_METHOD, err)
+	}
+	if test.TestHandler.LastRequest() != nil {
+		t.Fatalf("UpdateForkChoiceAndBuildBlock - expected no request to be sent, got %s", test.TestHandler.LastRequest())
+	}
+}
+
+func TestNegotiateCapabilities_success(t *testing.T) {
+	defer activateCancun(0)()
+	defer setCapabilities()()
+	test.TestHandler.SetResponse([]byte(`{"result": ["engine_forkchoiceUpdatedV3", "engine_newPayloadV3", "engine_getPayloadV3", "engine_getPayloadBodiesByHashV1"]}`))
+
+	err := TestRpcClient.NegotiateCapabilities(context.Background())
+	if err != nil {
+		t.Fatalf("NegotiateCapabilities - expected %v, got %v", nil, err)
+	}
+	if method := test.TestHandler.LastMethod(); method != string(EXCHANGE_CAPABILITIES) {
+		t.Fatalf("NegotiateCapabilities - expected method %v, got %v", EXCHANGE_CAPABILITIES, method)
+	}
+	if !bytes.Contains(test.TestHandler.LastRequest(), []byte(`"params":[["engine_forkchoiceUpdatedV1",`)) {
+		t.Fatalf("NegotiateCapabilities - expected the supported methods to be advertised, got %s", test.TestHandler.LastRequest())
+	}
+	if !TestRpcClient.supports(GET_EXECUTION_PAYLOAD_V3, ENGINE_V3) || TestRpcClient.supports(GET_EXECUTION_PAYLOAD_V2, ENGINE_V2) {
+		t.Fatalf("NegotiateCapabilities - capabilities were not recorded: %v", TestRpcClient.capabilities)
+	}
+}
+
+func TestNegotiateCapabilities_incompatible(t *testing.T) {
+	defer activateCancun(0)()
+	defer setCapabilities()()
+	test.TestHandler.SetResponse([]byte(`{"result": ["engine_forkchoiceUpdatedV2", "engine_newPayloadV2", "engine_getPayloadV2"]}`))
+
+	err := TestRpcClient.NegotiateCapabilities(context.Background())
+	if !test.ErrorIs(err, ERR_NO_COMPATIBLE_METHOD) {
+		t.Fatalf("NegotiateCapabilities - expected %v, got %v", ERR_NO_COMPATIBLE_METHOD, err)
+	}
+}
+
+func TestNegotiateCapabilities_fallbackToTransitionConfiguration(t *testing.T) {
+	defer setCapabilities()()
+	methods := make([]string, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		method := test.TestHandler.LastMethod()
+		methods = append(methods, method)
+		if method == string(EXCHANGE_CAPABILITIES) {
+			resp.Write([]byte(`{"error": {"code": -32601, "message": "the method engine_exchangeCapabilities does not exist/is not available"}}`))
+			return
+		}
+		resp.Write([]byte(`{"result": {"terminalTotalDifficulty": "0x0", "terminalBlockHash": "0x0000000000000000000000000000000000000000000000000000000000000000", "terminalBlockNumber": "0x0"}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+
+	err := TestRpcClient.NegotiateCapabilities(context.Background())
+	if err != nil {
+		t.Fatalf("NegotiateCapabilities - expected %v, got %v", nil, err)
+	}
+	if len(methods) != 2 || methods[1] != string(EXCHANGE_TRANSITION_CONFIGURATION) {
+		t.Fatalf("NegotiateCapabilities - expected a fallback to %v, got %v", EXCHANGE_TRANSITION_CONFIGURATION, methods)
+	}
+	if !TestRpcClient.supports(NEW_EXECUTION_PAYLOAD, ENGINE_V1) || TestRpcClient.supports(NEW_EXECUTION_PAYLOAD_V2, ENGINE_V2) {
+		t.Fatalf("NegotiateCapabilities - expected only V1 methods, got %v", TestRpcClient.capabilities)
+	}
+}
+
+func TestNewRequest_uniqueIds(t *testing.T) {
+	first, second := NewRequest(FORK_CHOICE_UPDATED), NewRequest(FORK_CHOICE_UPDATED)
+	if second.Id <= first.Id {
+		t.Fatalf("NewRequest - expected increasing ids, got %v then %v", first.Id, second.Id)
+	}
+}
+
+func TestUpdateForkChoice_responseIdMismatch(t *testing.T) {
+	defer withoutEchoedIds()()
+	previousRetryStrategy := DefaultRetryStrategy
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	defer func() { DefaultRetryStrategy = previousRetryStrategy }()
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "id": 0, "result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	mismatch, ok := err.(*ResponseIdMismatchError)
+	if !ok || mismatch.Actual == nil || *mismatch.Actual != 0 || mismatch.Method != FORK_CHOICE_UPDATED {
+		t.Fatalf("UpdateForkChoice - expected a %T for id 0, got %v", mismatch, err)
+	}
+	if !IsRetryable(err) {
+		t.Fatalf("IsRetryable - expected %v, got %v", true, false)
+	}
+}
+
+func TestUpdateForkChoice_nullResultWithMismatchedId(t *testing.T) {
+	defer withoutEchoedIds()()
+	previousRetryStrategy := DefaultRetryStrategy
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	defer func() { DefaultRetryStrategy = previousRetryStrategy }()
+	// The id is checked before the result, which belongs to a different request
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "id": 0, "result": null}`))
+
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if mismatch, ok := err.(*ResponseIdMismatchError); !ok || mismatch.Actual == nil || *mismatch.Actual != 0 {
+		t.Fatalf("UpdateForkChoice - expected a %T for id 0, got %v", mismatch, err)
+	}
+}
+
+func TestUpdateForkChoice_missingId(t *testing.T) {
+	defer withoutEchoedIds()()
+	previousRetryStrategy := DefaultRetryStrategy
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	defer func() { DefaultRetryStrategy = previousRetryStrategy }()
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if mismatch, ok := err.(*ResponseIdMismatchError); !ok || mismatch.Actual != nil {
+		t.Fatalf("UpdateForkChoice - expected a %T without an id, got %v", mismatch, err)
+	}
+}
+
+func TestUpdateForkChoice_errorWithNullId(t *testing.T) {
+	defer withoutEchoedIds()()
+	test.TestHandler.SetResponse([]byte(`{"jsonrpc": "2.0", "id": null, "error": {"code": -32700, "message": "Parse error"}}`))
+	_, err := TestRpcClient.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	rpcErr, ok := err.(*JsonRpcError)
+	if !ok || rpcErr.Code != -32700 {
+		t.Fatalf("UpdateForkChoice - expected the parse error, got %v", err)
+	}
+}
+
+func TestGetResponse_retriesWithNewId(t *testing.T) {
+	ids := make([]uint64, 0)
+	test.TestHandler.SetHandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request Request
+		json.Unmarshal(test.TestHandler.LastRequest(), &request)
+		ids = append(ids, request.Id)
+		if len(ids) == 1 {
+			resp.Write([]byte(`{"error": {"code": -32000, "message": "Server error"}}`))
+			return
+		}
+		resp.Write([]byte(`{"result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`))
+	})
+	defer func() { test.TestHandler.SetHandlerFunc(nil) }()
+
+	_, err := getResponse[*ForkChoiceUpdatedResult](context.Background(), &TestRpcClient, NewRequest(FORK_CHOICE_UPDATED, &commands.ForkChoiceState{}), MethodPolicy{
+		Timeout: time.Second,
+		Backoff: &BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 1, MaxInterval: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("getResponse - expected %v, got %v", nil, err)
+	}
+	if len(ids) != 2 || ids[0] == ids[1] {
+		t.Fatalf("getResponse - expected the retry to use a new id, got %v", ids)
+	}
+}
+
+func TestGetResponse_discardsStaleResponseAfterRetry(t *testing.T) {
+	var mu sync.Mutex
+	ids := make([]uint64, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var request Request
+		json.NewDecoder(req.Body).Decode(&request)
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, request.Id)
+		switch len(ids) {
+		case 1:
+			resp.Write([]byte(fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "error": {"code": -32000, "message": "Server error"}}`, request.Id)))
+		case 2:
+			// A late answer to the first attempt, e.g. from a proxy, arrives in place of the answer to the retry
+			resp.Write([]byte(fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "result": {"payloadStatus": {"status": "INVALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`, ids[0])))
+		default:
+			resp.Write([]byte(fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "result": {"payloadStatus": {"status": "VALID", "latestValidHash": null, "validationError": null}, "payloadId": null}}`, request.Id)))
+		}
+	}))
+	defer server.Close()
+	client := NewClient("8545")
+	client.SetEndpoint(server.URL)
+
+	result, err := getResponse[*ForkChoiceUpdatedResult](context.Background(), &client, NewRequest(FORK_CHOICE_UPDATED, &commands.ForkChoiceState{}), MethodPolicy{
+		Timeout: time.Second,
+		Backoff: &BackoffConfig{InitialInterval: time.Millisecond, Multiplier: 1, MaxInterval: time.Millisecond},
+	})
+	if err != nil || result.PayloadStatus.Status != VALID_PAYLOAD {
+		t.Fatalf("getResponse - expected the response to the last attempt, got %v. err %v", result, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 3 || ids[1] == ids[0] || ids[2] == ids[1] {
+		t.Fatalf("getResponse - expected each attempt to use a new id, got %v", ids)
+	}
+}
+
+func TestUpdateForkChoice_cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := TestRpcClient.UpdateForkChoice(ctx, &commands.ForkChoiceState{})
+	if !test.ErrorIs(err, ERR_REQUEST_CANCELLED) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_CANCELLED, err)
+	}
+}
+
+func TestUpdateForkChoice_cancelledInFlight(t *testing.T) {
+	// The handler may still be running when the request is abandoned. Closing the server waits for it, so it can't
+	// reach the next test
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		// The server only notices that the client went away once the body has been read
+		io.ReadAll(req.Body)
+		<-req.Context().Done()
+	}))
+	defer server.Close()
+	client := NewClient("8545")
+	client.SetEndpoint(server.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.UpdateForkChoice(ctx, &commands.ForkChoiceState{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestGetResponse_cancelledDuringRetry(t *testing.T) {
+	test.TestHandler.SetResponse([]byte(`{"error": {"code": -32000, "message": "Server error"}}`))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := getResponse[*ForkChoiceUpdatedResult](ctx, &TestRpcClient, NewRequest(FORK_CHOICE_UPDATED, &commands.ForkChoiceState{}), MethodPolicy{
+		Timeout: time.Second,
+		Backoff: &BackoffConfig{InitialInterval: time.Second, Multiplier: 1, MaxInterval: time.Second},
+	})
+	if !test.ErrorIs(err, ERR_REQUEST_CANCELLED) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("getResponse - expected %v, got %v", ERR_REQUEST_CANCELLED, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("getResponse - expected the retry sleep to be abandoned, took %v", elapsed)
+	}
+}
+
+func TestJsonRpcError_catalog(t *testing.T) {
+	tests := []struct {
+		sentinel  *JsonRpcError
+		retryable bool
+	}{
+		{ERR_PARSE_ERROR, false},
+		{ERR_INVALID_REQUEST, false},
+		{ERR_METHOD_NOT_FOUND, false},
+		{ERR_INVALID_PARAMS, false},
+		{ERR_INTERNAL_ERROR, true},
+		{ERR_SERVER_ERROR, true},
+		{ERR_UNKNOWN_PAYLOAD, false},
+		{ERR_INVALID_FORKCHOICE_STATE, false},
+		{ERR_INVALID_PAYLOAD_ATTRIBUTES, false},
+		{ERR_TOO_LARGE_REQUEST, false},
+		{ERR_UNSUPPORTED_FORK, false},
+	}
+	for _, tt := range tests {
+		test.TestHandler.SetResponse([]byte(fmt.Sprintf(`{"jsonrpc": "2.0", "error": {"code": %d, "message": "from the execution client"}}`, tt.sentinel.Code)))
+		_, err := TestRpcClient.GetPayload(context.Background(), "0x0000000000000000", 0)
+		if !errors.Is(err, tt.sentinel) || errors.Is(err, ERR_TOO_LARGE_REQUEST) != (tt.sentinel == ERR_TOO_LARGE_REQUEST) {
+			t.Errorf("GetPayload - expected %v, got %v", tt.sentinel, err)
+		}
+		if IsRetryable(err) != tt.retryable {
+			t.Errorf("IsRetryable(%v) - expected %v, got %v", err, tt.retryable, !tt.retryable)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/ledgerwatch/log/v3"
+)
+
+const IPC_SCHEME = "ipc"
+
+// Carries marshalled JSON-RPC messages to the execution client
+type Transport interface {
+	// Sends the message and returns the raw response. The auth token is empty if the client has no JWT, and is
+	// ignored by transports which don't authenticate with one
+	Send(ctx context.Context, msg []byte, authToken string) ([]byte, error)
+}
+
+// Returns the transport for the endpoint, chosen by its scheme
+func newTransport(endpoint string, tlsConfig *tls.Config) Transport {
+	if path, ok := ipcPath(endpoint); ok {
+		return &IpcTransport{Path: path}
+	}
+	if parsed, err := url.Parse(endpoint); err == nil && isWsScheme(parsed.Scheme) {
+		return NewWsTransport(endpoint, tlsConfig)
+	}
+	client := http.DefaultClient
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport}
+	}
+	return &HttpTransport{Endpoint: endpoint, Client: client}
+}
+
+// Returns the socket path of an ipc:// endpoint
+func ipcPath(endpoint string) (string, bool) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || parsed.Scheme != IPC_SCHEME {
+		return "", false
+	}
+	if parsed.Opaque != "" {
+		return parsed.Opaque, true
+	}
+	return parsed.Path, true
+}
+
+// Sends each message as the body of an HTTP POST, authenticated with the JWT as a bearer token
+type HttpTransport struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+func (t *HttpTransport) Send(ctx context.Context, msg []byte, authToken string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.Endpoint, bytes.NewBuffer(msg))
+	if err != nil {
+		err = ErrFrom(ERR_REQUEST_CREATION_FAILED, err)
+		log.Crit(err.Error())
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{"application/json"}
+	if authToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", authToken))
+	}
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, ErrFrom(ERR_REQUEST_SEND_FAILED, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, ErrFrom(ERR_RESPONSE_READ_FAILED, fmt.Errorf("Error reading response to msg %s. %w", msg, err))
+	}
+	return body, nil
+}
+
+// Sends each message over a new connection to a Unix domain socket. Access to the socket is controlled by its file
+// permissions, and execution clients don't authenticate requests on their IPC endpoints, so the auth token is ignored.
+// Regent doesn't load a JWT secret for an ipc endpoint, see the jwt-secret option
+type IpcTransport struct {
+	Path string
+}
+
+func (t *IpcTransport) Send(ctx context.Context, msg []byte, authToken string) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", t.Path)
+	if err != nil {
+		return nil, ErrFrom(ERR_REQUEST_SEND_FAILED, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// The deadline doesn't cover a context which is cancelled, e.g. on shutdown, so the connection is closed to stop
+	// waiting for the response
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if _, err = conn.Write(msg); err != nil {
+		return nil, ipcError(ctx, ERR_REQUEST_SEND_FAILED, err)
+	}
+	// Messages on the socket aren't delimited, so the response ends with the first complete JSON value
+	var response json.RawMessage
+	err = json.NewDecoder(conn).Decode(&response)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return nil, ErrFrom(ERR_UNMARSHALLING_FAILED, fmt.Errorf("Error unmarshalling response to msg %s. err %w", msg, err))
+	}
+	if err != nil {
+		return nil, ipcError(ctx, ERR_RESPONSE_READ_FAILED, fmt.Errorf("Error reading response to msg %s. %w", msg, err))
+	}
+	return response, nil
+}
+
+// Reports a failure on the socket as a cancelled request if the context was cancelled, since closing the connection
+// is what made it fail
+func ipcError(ctx context.Context, msg string, err error) error {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return ErrFrom(ERR_REQUEST_CANCELLED, ctx.Err())
+	}
+	return ErrFrom(msg, err)
+}
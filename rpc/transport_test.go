@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"regent/utils/test"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+)
+
+// Serves each connection to a Unix socket in a temporary directory with the given handler.
+// Returns the ipc:// endpoint of the socket
+func newIpcServer(t *testing.T, handle func(conn net.Conn)) string {
+	path := filepath.Join(t.TempDir(), "engine.ipc")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("could not listen on %v: %v", path, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return "ipc://" + path
+}
+
+// Replies to a single request with the given response, after recording the request's method.
+// The response is given the id of the request unless it already has a non-null one
+func respondOverIpc(response string, methods chan<- string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		var body json.RawMessage
+		var request Request
+		if err := json.NewDecoder(conn).Decode(&body); err != nil || json.Unmarshal(body, &request) != nil {
+			return
+		}
+		methods <- string(request.Method)
+		conn.Write(test.WithRequestId([]byte(response), body))
+	}
+}
+
+func TestIpcTransport_success(t *testing.T) {
+	methods := make(chan string, 1)
+	endpoint := newIpcServer(t, respondOverIpc(forkChoiceResponse, methods))
+	client, err := NewClientFromUrl(endpoint, nil)
+	if err != nil {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", nil, err)
+	}
+	client.SetAuthToken(TestRpcClient.authToken)
+
+	result, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if err != nil || result.PayloadStatus.Status != VALID_PAYLOAD {
+		t.Fatalf("UpdateForkChoice - expected status %v, got %+v. err %v", VALID_PAYLOAD, result, err)
+	}
+	if method := <-methods; method != string(FORK_CHOICE_UPDATED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", FORK_CHOICE_UPDATED, method)
+	}
+}
+
+func TestIpcTransport_jsonRpcError(t *testing.T) {
+	methods := make(chan string, 1)
+	endpoint := newIpcServer(t, respondOverIpc(`{"jsonrpc":"2.0","error":{"code":-38002,"message":"Invalid forkchoice state"}}`, methods))
+	client, _ := NewClientFromUrl(endpoint, nil)
+
+	_, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	rpcErr, ok := err.(*JsonRpcError)
+	if !ok || rpcErr.Code != CODE_INVALID_FORKCHOICE_STATE {
+		t.Fatalf("UpdateForkChoice - expected code %v, got %v", CODE_INVALID_FORKCHOICE_STATE, err)
+	}
+}
+
+func TestIpcTransport_errors(t *testing.T) {
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+
+	// Nothing listens on the socket
+	client, _ := NewClientFromUrl("ipc://"+filepath.Join(t.TempDir(), "missing.ipc"), nil)
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
+	}
+
+	// The connection is closed before a response is sent
+	client, _ = NewClientFromUrl(newIpcServer(t, func(conn net.Conn) {}), nil)
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_RESPONSE_READ_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_RESPONSE_READ_FAILED, err)
+	}
+
+	// The response isn't JSON
+	client, _ = NewClientFromUrl(newIpcServer(t, func(conn net.Conn) { conn.Write([]byte("not json")) }), nil)
+	if _, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{}); !test.ErrorIs(err, ERR_UNMARSHALLING_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_UNMARSHALLING_FAILED, err)
+	}
+}
+
+func TestIpcTransport_cancelled(t *testing.T) {
+	// The execution client never answers
+	endpoint := newIpcServer(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	client, _ := NewClientFromUrl(endpoint, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := client.UpdateForkChoice(ctx, &commands.ForkChoiceState{})
+	if !test.ErrorIs(err, ERR_REQUEST_CANCELLED) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_CANCELLED, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("UpdateForkChoice - expected to stop waiting for the response when cancelled, took %v", elapsed)
+	}
+}
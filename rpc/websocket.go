@@ -0,0 +1,286 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ledgerwatch/log/v3"
+)
+
+const WS_HANDSHAKE_TIMEOUT = 5 * time.Second
+
+// Sends messages over a single persistent WebSocket connection. Concurrent requests share the connection and are
+// matched with their responses by JSON-RPC id. If the connection drops, the next request reconnects and
+// re-authenticates with its own token, so callers only see the requests which were in flight at the time
+type WsTransport struct {
+	Endpoint string
+	dialer   websocket.Dialer
+
+	// Guards the connection, the pending requests and writes to the connection. Not held while dialling
+	mu   sync.Mutex
+	conn *websocket.Conn
+	// Closed once the dial in progress finishes, or nil if there is none
+	dialing chan struct{}
+	// The requests awaiting a response, keyed by the id the transport assigned them
+	pending map[uint64]*pendingRequest
+	nextId  uint64
+}
+
+type pendingRequest struct {
+	// The ids chosen by the caller, keyed by the ids the transport assigned. A batch has one entry per request
+	originalIds map[uint64]json.RawMessage
+	response    chan wsResult
+}
+
+type wsResult struct {
+	body []byte
+	err  error
+}
+
+func NewWsTransport(endpoint string, tlsConfig *tls.Config) *WsTransport {
+	return &WsTransport{
+		Endpoint: endpoint,
+		dialer: websocket.Dialer{
+			Proxy:            http.ProxyFromEnvironment,
+			HandshakeTimeout: WS_HANDSHAKE_TIMEOUT,
+			TLSClientConfig:  tlsConfig,
+		},
+		pending: make(map[uint64]*pendingRequest),
+	}
+}
+
+// Splits a message, which is either a single JSON-RPC object or a batch of them, into its objects
+func splitMessage(msg []byte) ([]map[string]json.RawMessage, bool, error) {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		batch := make([]map[string]json.RawMessage, 0)
+		err := json.Unmarshal(trimmed, &batch)
+		return batch, true, err
+	}
+	single := make(map[string]json.RawMessage)
+	err := json.Unmarshal(trimmed, &single)
+	return []map[string]json.RawMessage{single}, false, err
+}
+
+func joinMessage(objects []map[string]json.RawMessage, isBatch bool) ([]byte, error) {
+	if isBatch {
+		return json.Marshal(objects)
+	}
+	return json.Marshal(objects[0])
+}
+
+func (t *WsTransport) Send(ctx context.Context, msg []byte, authToken string) ([]byte, error) {
+	objects, isBatch, err := splitMessage(msg)
+	if err != nil {
+		return nil, ErrFrom(ERR_REQUEST_CREATION_FAILED, err)
+	}
+	request := &pendingRequest{originalIds: make(map[uint64]json.RawMessage), response: make(chan wsResult, 1)}
+
+	if err := t.write(ctx, objects, isBatch, request, authToken); err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-request.response:
+		return result.body, result.err
+	case <-ctx.Done():
+		t.mu.Lock()
+		for id := range request.originalIds {
+			delete(t.pending, id)
+		}
+		t.mu.Unlock()
+		return nil, ErrFrom(ERR_RESPONSE_READ_FAILED, fmt.Errorf("no response to msg %s. %w", msg, ctx.Err()))
+	}
+}
+
+// Assigns each request an id which is unique on this transport, registers them as pending and writes the message
+// to the connection. A write which fails on an existing connection is retried once on a fresh one, since the
+// execution client may have closed an idle connection
+func (t *WsTransport) write(ctx context.Context, objects []map[string]json.RawMessage, isBatch bool, request *pendingRequest, authToken string) error {
+	t.mu.Lock()
+	for _, object := range objects {
+		t.nextId++
+		request.originalIds[t.nextId] = object["id"]
+		object["id"] = json.RawMessage(strconv.FormatUint(t.nextId, 10))
+	}
+	t.mu.Unlock()
+	msg, err := joinMessage(objects, isBatch)
+	if err != nil {
+		return ErrFrom(ERR_MARSHALLING_FAILED, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := t.connect(ctx, authToken)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		for id := range request.originalIds {
+			t.pending[id] = request
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+		err = conn.WriteMessage(websocket.TextMessage, msg)
+		// The deadline belongs to this request, so it must not cut short the writes of later ones
+		conn.SetWriteDeadline(time.Time{})
+		if err == nil {
+			t.mu.Unlock()
+			return nil
+		}
+		for id := range request.originalIds {
+			delete(t.pending, id)
+		}
+		t.dropConnection(conn)
+		t.mu.Unlock()
+		if !reused || attempt > 0 {
+			return ErrFrom(ERR_REQUEST_SEND_FAILED, err)
+		}
+		log.Debug("Reconnecting to the execution client", "endpoint", t.Endpoint, "err", err)
+	}
+}
+
+// Returns the open connection, and whether it was already open, or dials a new one if there is none. The lock is
+// released while dialling, so a slow handshake doesn't hold up responses, cancellations or Close. Requests which
+// need a connection while another one is dialling wait for it rather than dialling their own
+func (t *WsTransport) connect(ctx context.Context, authToken string) (*websocket.Conn, bool, error) {
+	for {
+		t.mu.Lock()
+		if conn := t.conn; conn != nil {
+			t.mu.Unlock()
+			return conn, true, nil
+		}
+		if dialing := t.dialing; dialing != nil {
+			t.mu.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, false, ErrFrom(ERR_REQUEST_SEND_FAILED, ctx.Err())
+			}
+		}
+		dialing := make(chan struct{})
+		t.dialing = dialing
+		t.mu.Unlock()
+
+		conn, err := t.dial(ctx, authToken)
+		t.mu.Lock()
+		t.dialing = nil
+		close(dialing)
+		if err == nil {
+			t.conn = conn
+			go t.readLoop(conn)
+		}
+		t.mu.Unlock()
+		return conn, false, err
+	}
+}
+
+func (t *WsTransport) dial(ctx context.Context, authToken string) (*websocket.Conn, error) {
+	header := http.Header{}
+	if authToken != "" {
+		header.Set("Authorization", fmt.Sprintf("Bearer %v", authToken))
+	}
+	conn, resp, err := t.dialer.DialContext(ctx, t.Endpoint, header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		return nil, ErrFrom(ERR_REQUEST_SEND_FAILED, err)
+	}
+	return conn, nil
+}
+
+// Delivers each response on the connection to the request with the same id, until the connection fails
+func (t *WsTransport) readLoop(conn *websocket.Conn) {
+	for {
+		_, body, err := conn.ReadMessage()
+		if err != nil {
+			t.mu.Lock()
+			t.dropConnection(conn)
+			t.mu.Unlock()
+			return
+		}
+
+		request, objects, isBatch := t.match(body)
+		if request == nil {
+			log.Warn("Ignoring a WebSocket message which is not a response to a pending request", "msg", string(body))
+			continue
+		}
+		for _, object := range objects {
+			var id uint64
+			if json.Unmarshal(object["id"], &id) != nil {
+				continue
+			}
+			if originalId, ok := request.originalIds[id]; ok && originalId != nil {
+				object["id"] = originalId
+			} else if ok {
+				delete(object, "id")
+			}
+		}
+		body, err = joinMessage(objects, isBatch)
+		request.response <- wsResult{body: body, err: err}
+	}
+}
+
+// Finds the pending request which a response belongs to, and removes it from the pending requests.
+// A batch is matched by the first of its entries with an id
+func (t *WsTransport) match(body []byte) (*pendingRequest, []map[string]json.RawMessage, bool) {
+	objects, isBatch, err := splitMessage(body)
+	if err != nil {
+		return nil, nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, object := range objects {
+		var id uint64
+		if json.Unmarshal(object["id"], &id) != nil {
+			continue
+		}
+		request, ok := t.pending[id]
+		if !ok {
+			return nil, nil, false
+		}
+		for id := range request.originalIds {
+			delete(t.pending, id)
+		}
+		return request, objects, isBatch
+	}
+	return nil, nil, false
+}
+
+// Closes the connection and fails the requests waiting for a response on it. Must be called with the lock held
+func (t *WsTransport) dropConnection(conn *websocket.Conn) {
+	if conn == nil || t.conn != conn {
+		return
+	}
+	conn.Close()
+	t.conn = nil
+	// A batch has an entry per request, all of which share its pendingRequest. Each request is failed once, since
+	// its channel only holds one result
+	failed := make(map[*pendingRequest]bool)
+	for id, request := range t.pending {
+		delete(t.pending, id)
+		if failed[request] {
+			continue
+		}
+		failed[request] = true
+		request.response <- wsResult{err: ErrFrom(ERR_RESPONSE_READ_FAILED, fmt.Errorf("the connection to %v was closed", t.Endpoint))}
+	}
+}
+
+// Closes the connection. The next request reconnects
+func (t *WsTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dropConnection(t.conn)
+	return nil
+}
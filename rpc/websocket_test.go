@@ -0,0 +1,234 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regent/utils/test"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ledgerwatch/erigon/cmd/rpcdaemon/commands"
+	"github.com/ledgerwatch/erigon/common"
+)
+
+// A WebSocket server which answers each fork choice update with its head hash as the latest valid hash
+type wsServer struct {
+	*httptest.Server
+	mu sync.Mutex
+	// The Authorization header of each handshake
+	authHeaders []string
+	// The first requests are held until this many have arrived, and are then answered in reverse order.
+	// Later requests are answered immediately
+	firstBatch int
+	// Whether to close each connection after answering a batch
+	closeAfterBatch bool
+}
+
+func newWsServer(firstBatch int) *wsServer {
+	server := &wsServer{firstBatch: firstBatch}
+	upgrader := websocket.Upgrader{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		server.mu.Lock()
+		server.authHeaders = append(server.authHeaders, req.Header.Get("Authorization"))
+		server.mu.Unlock()
+		if req.Header.Get("Authorization") == "" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(resp, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for batchSize := server.firstBatch; ; batchSize = 1 {
+			requests := make([]struct {
+				Id     uint64                     `json:"id"`
+				Params []commands.ForkChoiceState `json:"params"`
+			}, batchSize)
+			for i := range requests {
+				if err := conn.ReadJSON(&requests[i]); err != nil {
+					return
+				}
+			}
+			for i := len(requests) - 1; i >= 0; i-- {
+				response := fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"result":{"payloadStatus":{"status":"VALID","latestValidHash":"%v","validationError":null},"payloadId":null}}`, requests[i].Id, requests[i].Params[0].HeadHash.Hex())
+				conn.WriteMessage(websocket.TextMessage, []byte(response))
+			}
+			if server.closeAfterBatch {
+				return
+			}
+		}
+	}))
+	return server
+}
+
+func (s *wsServer) handshakes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.authHeaders...)
+}
+
+func newWsClient(t *testing.T, server *wsServer) Client {
+	client, err := NewClientFromUrl("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("NewClientFromUrl - expected %v, got %v", nil, err)
+	}
+	client.SetAuthToken(TestRpcClient.authToken)
+	return client
+}
+
+// Sends a fork choice update with the given head and checks that the response is for the same head
+func updateHead(t *testing.T, client *Client, head common.Hash) {
+	result, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{HeadHash: head})
+	if err != nil {
+		t.Errorf("UpdateForkChoice - expected %v, got %v", nil, err)
+		return
+	}
+	if *result.PayloadStatus.LatestValidHash != head {
+		t.Errorf("UpdateForkChoice - expected the response for %v, got %v", head, *result.PayloadStatus.LatestValidHash)
+	}
+}
+
+func TestWsTransport_multiplexesConcurrentRequests(t *testing.T) {
+	const requests = 4
+	server := newWsServer(requests)
+	defer server.Close()
+	client := newWsClient(t, server)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 1; i <= requests; i++ {
+		wg.Add(1)
+		go func(head common.Hash) {
+			defer wg.Done()
+			updateHead(t, &client, head)
+		}(common.HexToHash(fmt.Sprintf("0x%02x", i)))
+	}
+	wg.Wait()
+
+	// Later requests reuse the connection
+	updateHead(t, &client, common.HexToHash("0x05"))
+	if handshakes := server.handshakes(); len(handshakes) != 1 || !strings.HasPrefix(handshakes[0], "Bearer ") {
+		t.Fatalf("UpdateForkChoice - expected a single authenticated connection, got %v", handshakes)
+	}
+}
+
+func TestWsTransport_reconnects(t *testing.T) {
+	server := newWsServer(1)
+	server.closeAfterBatch = true
+	defer server.Close()
+	client := newWsClient(t, server)
+	defer client.Close()
+
+	updateHead(t, &client, common.HexToHash("0x01"))
+	// Wait for the transport to notice that the server closed the connection
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		client.transport.(*WsTransport).mu.Lock()
+		closed := client.transport.(*WsTransport).conn == nil
+		client.transport.(*WsTransport).mu.Unlock()
+		if closed {
+			break
+		}
+	}
+	updateHead(t, &client, common.HexToHash("0x02"))
+
+	handshakes := server.handshakes()
+	if len(handshakes) != 2 || !strings.HasPrefix(handshakes[1], "Bearer ") {
+		t.Fatalf("UpdateForkChoice - expected to reconnect with a token, got %v", handshakes)
+	}
+}
+
+func TestWsTransport_failsBatchWhenConnectionDrops(t *testing.T) {
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	// The server expects single requests, so it closes the connection without answering the batch
+	server := newWsServer(1)
+	server.closeAfterBatch = true
+	defer server.Close()
+	client := newWsClient(t, server)
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.SendBatch(context.Background(), forkChoiceBatch(common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03")))
+	}()
+	select {
+	case err := <-done:
+		if !test.ErrorIs(err, ERR_RESPONSE_READ_FAILED) {
+			t.Fatalf("SendBatch - expected %v, got %v", ERR_RESPONSE_READ_FAILED, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SendBatch - expected the batch to fail when the connection dropped, but it hung")
+	}
+	// The transport is still usable
+	updateHead(t, &client, common.HexToHash("0x04"))
+}
+
+func TestWsTransport_clearsWriteDeadline(t *testing.T) {
+	server := newWsServer(1)
+	defer server.Close()
+	client := newWsClient(t, server)
+	defer client.Close()
+	token, _ := client.authToken.TokenString()
+	msg := []byte(`{"jsonrpc":"2.0","method":"engine_forkchoiceUpdatedV1","params":[{}],"id":1}`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := client.transport.(*WsTransport).Send(ctx, msg, token); err != nil {
+		t.Fatalf("Send - expected %v, got %v", nil, err)
+	}
+	<-ctx.Done()
+	// A request without a deadline doesn't inherit the deadline of the previous one, which would time out the write
+	// and drop the connection
+	if _, err := client.transport.(*WsTransport).Send(context.Background(), msg, token); err != nil {
+		t.Fatalf("Send - expected %v, got %v", nil, err)
+	}
+	if handshakes := server.handshakes(); len(handshakes) != 1 {
+		t.Fatalf("Send - expected to reuse the connection, got %d handshakes", len(handshakes))
+	}
+}
+
+func TestWsTransport_closeDoesNotWaitForDial(t *testing.T) {
+	// The handshake never completes
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	transport := NewWsTransport("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go transport.Send(ctx, []byte(`{"jsonrpc":"2.0","method":"engine_forkchoiceUpdatedV1","params":[{}],"id":1}`), "token")
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		transport.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close - expected not to wait for the handshake, but it blocked")
+	}
+}
+
+func TestWsTransport_unauthorized(t *testing.T) {
+	defer func(previous func() RetryStrategy) { DefaultRetryStrategy = previous }(DefaultRetryStrategy)
+	DefaultRetryStrategy = func() RetryStrategy { return &test.NoRetryStrategy{} }
+	server := newWsServer(1)
+	defer server.Close()
+	client := newWsClient(t, server)
+	client.SetAuthToken(nil)
+
+	_, err := client.UpdateForkChoice(context.Background(), &commands.ForkChoiceState{})
+	if !test.ErrorIs(err, ERR_REQUEST_SEND_FAILED) {
+		t.Fatalf("UpdateForkChoice - expected %v, got %v", ERR_REQUEST_SEND_FAILED, err)
+	}
+}
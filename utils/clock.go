@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"time"
+)
+
+// The source of the current time and of waits. Code which depends on time takes a Clock, so that tests can replace
+// the wall clock with a fake one
+type Clock interface {
+	Now() time.Time
+	// Waits for the given duration, unless ctx is cancelled first, in which case ctx.Err() is returned
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// The wall clock
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
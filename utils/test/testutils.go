@@ -1,14 +1,19 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"time"
 )
 
-var TestHandler = MockHandler{}
-var TestServer = httptest.NewServer(&TestHandler)
+var TestHandler = &MockHandler{}
+var TestServer = httptest.NewServer(TestHandler)
 
 type NoRetryStrategy struct{}
 
@@ -20,20 +25,213 @@ func (s *NoRetryStrategy) Done() bool {
 	return true
 }
 
+// Answers JSON-RPC requests in tests. The server calls it on its own goroutines, so tests change and inspect it
+// through its methods
 type MockHandler struct {
-	Response    []byte
-	HandlerFunc func(resp http.ResponseWriter, req *http.Request)
+	mu          sync.Mutex
+	response    []byte
+	handlerFunc func(resp http.ResponseWriter, req *http.Request)
+	// The body of the most recent request received by the handler
+	lastRequest []byte
+	// Whether responses without an id are given the id of the request
+	echoIds bool
+	// Whether the requests in a batch are answered one at a time
+	splitBatches bool
+}
+
+// Creates a handler which answers each request with the given function
+func NewMockHandler(handlerFunc func(resp http.ResponseWriter, req *http.Request)) *MockHandler {
+	return &MockHandler{handlerFunc: handlerFunc}
 }
 
 func (m *MockHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	if m.HandlerFunc != nil {
-		m.HandlerFunc(resp, req)
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		m.serve(resp, req, nil)
+		return
+	}
+	m.mu.Lock()
+	splitBatches := m.splitBatches
+	m.mu.Unlock()
+	var batch []json.RawMessage
+	if !splitBatches || json.Unmarshal(body, &batch) != nil {
+		m.serve(resp, req, body)
+		return
+	}
+	// Requests which get no response are left out of the batch response, like a server which drops them
+	responses := make([][]byte, 0, len(batch))
+	for _, request := range batch {
+		recorder := httptest.NewRecorder()
+		m.serve(recorder, req.Clone(req.Context()), request)
+		if response := bytes.TrimSpace(recorder.Body.Bytes()); len(response) > 0 {
+			responses = append(responses, response)
+		}
+	}
+	resp.WriteHeader(200)
+	resp.Write([]byte("[" + string(bytes.Join(responses, []byte(","))) + "]"))
+}
+
+// Answers a single request with the given body
+func (m *MockHandler) serve(resp http.ResponseWriter, req *http.Request, body []byte) {
+	m.mu.Lock()
+	if body != nil {
+		m.lastRequest = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	handlerFunc, response, echoIds := m.handlerFunc, m.response, m.echoIds
+	m.mu.Unlock()
+	if echoIds {
+		resp = &idWriter{ResponseWriter: resp, request: body}
+	}
+	if handlerFunc != nil {
+		handlerFunc(resp, req)
 		return
 	}
 	resp.WriteHeader(200)
-	resp.Write(m.Response)
+	resp.Write(response)
+}
+
+// Sets the body of the response to every request. Only used when there is no handler function
+func (m *MockHandler) SetResponse(response []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.response = response
+}
+
+// Answers each request with the given function instead of the response. Nil restores the response
+func (m *MockHandler) SetHandlerFunc(handlerFunc func(resp http.ResponseWriter, req *http.Request)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlerFunc = handlerFunc
+}
+
+// The function which answers requests, or nil if the response is used
+func (m *MockHandler) HandlerFunc() func(resp http.ResponseWriter, req *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handlerFunc
+}
+
+// Gives responses without an id the id of the request, so canned responses don't need to know which id was sent.
+// Off by default, so that tests of response ids see exactly what the handler wrote
+func (m *MockHandler) SetEchoIds(echoIds bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.echoIds = echoIds
+}
+
+// Answers each request in a batch as if it had been sent on its own, and replies with the responses in an array.
+// Handlers then only ever see single requests, and LastRequest is the request being answered
+func (m *MockHandler) SetSplitBatches(splitBatches bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.splitBatches = splitBatches
+}
+
+// The body of the most recent request received by the handler, or nil if there was none since ClearLastRequest
+func (m *MockHandler) LastRequest() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastRequest
+}
+
+func (m *MockHandler) ClearLastRequest() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastRequest = nil
 }
 
 func ErrorIs(err error, kind string) bool {
 	return errors.Is(err, errors.New(kind))
 }
+
+// Returns the JSON-RPC method of the most recent request received by the handler
+func (m *MockHandler) LastMethod() string {
+	var msg struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal(m.LastRequest(), &msg)
+	return msg.Method
+}
+
+// Sets the id of a JSON-RPC response to the id of the request, unless the response already has a non-null one.
+// Responses which aren't JSON objects are returned unchanged
+func WithRequestId(response []byte, request []byte) []byte {
+	var requestFields, responseFields map[string]json.RawMessage
+	if json.Unmarshal(request, &requestFields) != nil || json.Unmarshal(response, &responseFields) != nil {
+		return response
+	}
+	if id, ok := responseFields["id"]; (ok && string(id) != "null") || responseFields == nil {
+		return response
+	}
+	responseFields["id"] = requestFields["id"]
+	withId, err := json.Marshal(responseFields)
+	if err != nil {
+		return response
+	}
+	return withId
+}
+
+// Answers each request with the id of the request, for handlers which echo ids
+type idWriter struct {
+	http.ResponseWriter
+	request []byte
+}
+
+func (w *idWriter) Write(response []byte) (int, error) {
+	_, err := w.ResponseWriter.Write(WithRequestId(response, w.request))
+	return len(response), err
+}
+
+// A clock whose time only moves when it is told to. Sleeping advances the time by the duration slept without
+// waiting, so code which waits for slots or retries runs in no time
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+	// The durations passed to Sleep, in order
+	sleeps []time.Duration
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sleeps = append(c.sleeps, d)
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+	return nil
+}
+
+// Moves the time forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Sets the time to t
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// The durations passed to Sleep so far
+func (c *FakeClock) Sleeps() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.sleeps...)
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"encoding/hex"
 	"log"
+	"os"
 	"strings"
 
 	"github.com/ledgerwatch/erigon/common"
@@ -24,3 +25,14 @@ func FromHex(input string) []byte {
 	}
 	return result
 }
+
+// Flushes the entries of a directory to disk. A file which was renamed into the directory only survives a crash
+// once the directory itself has been synced
+func SyncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}